@@ -17,29 +17,48 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/golang/glog"
 )
 
+const (
+	// groupNameTag is the tag aws places on the instances of an auto-scaling group
+	groupNameTag = "aws:autoscaling:groupName"
+	// describeBatchSize is the maximum number of instances described in a single call
+	describeBatchSize = 100
+	// awsMinThrottleDelay is the initial backoff when the api throttles us
+	awsMinThrottleDelay = time.Duration(500) * time.Millisecond
+	// awsMaxThrottleDelay is the maximum backoff when the api throttles us
+	awsMaxThrottleDelay = time.Duration(30) * time.Second
+)
+
+// newAwsClient creates the aws clients, backing off with jitter should the api throttle us
 func newAwsClient(region string) (*awsClient, error) {
 	glog.V(3).Infof("creating a aws client, region: %s", region)
 
-	// step: get the auto-scaling client
-	asg := autoscaling.New(session.New(), &aws.Config{
-		Region: aws.String(region),
+	cfg := request.WithRetryer(&aws.Config{Region: aws.String(region)}, client.DefaultRetryer{
+		NumMaxRetries:    config.awsMaxRetries,
+		MinThrottleDelay: awsMinThrottleDelay,
+		MaxThrottleDelay: awsMaxThrottleDelay,
 	})
+
+	// step: get the auto-scaling client
+	asg := autoscaling.New(session.New(), cfg)
 	// step: get the ec2 instance client
-	compute := ec2.New(session.New(), &aws.Config{
-		Region: aws.String(region),
-	})
+	compute := ec2.New(session.New(), cfg)
 
 	return &awsClient{
-		asg:     asg,
-		compute: compute,
+		asg:       asg,
+		compute:   compute,
+		instances: make(map[string]*ec2.Instance, 0),
 	}, nil
 }
 
@@ -47,119 +66,309 @@ func newAwsClient(region string) (*awsClient, error) {
 func (r *awsClient) getAutoScalingGroupWithInstanceID(id string) (string, error) {
 	glog.V(10).Infof("searching for autoscaling group with instance id: %s", id)
 
-	// step: iterate the auto-scaling groups
-	groups, err := r.asg.DescribeAutoScalingGroups(nil)
+	var name string
+	err := r.asg.DescribeAutoScalingInstancesPages(&autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	}, func(page *autoscaling.DescribeAutoScalingInstancesOutput, last bool) bool {
+		for _, i := range page.AutoScalingInstances {
+			if aws.StringValue(i.InstanceId) == id {
+				name = aws.StringValue(i.AutoScalingGroupName)
+				return false
+			}
+		}
+		return true
+	})
 	if err != nil {
 		return "", err
 	}
-	glog.V(10).Infof("found %d auto-scaling groups in region", len(groups.AutoScalingGroups))
+	if name == "" {
+		return "", fmt.Errorf("no auto-scaling group found with instance id: %s", id)
+	}
+	glog.V(3).Infof("found instance id: %s in group: %s", id, name)
 
-	// step: find the group which has the instance id
-	for _, g := range groups.AutoScalingGroups {
-		glog.V(10).Infof("checking scaling group: %s for instance id: %s", *g.AutoScalingGroupName, id)
-		for _, i := range g.Instances {
-			if *i.InstanceId == id {
-				glog.V(3).Infof("found instance id: %s in group: %s", id, *g.AutoScalingGroupName)
-				return *g.AutoScalingGroupName, nil
-			}
+	return name, nil
+}
+
+// describeInstances retrieves the instances in batches, returning those which exist keyed by id; any
+// already described during this run are served from the cache
+func (r *awsClient) describeInstances(ids []string) (map[string]*ec2.Instance, error) {
+	list := make(map[string]*ec2.Instance, 0)
+
+	var missing []string
+	for _, id := range uniqueList(ids...) {
+		if instance, found := r.instances[id]; found {
+			list[id] = instance
+			continue
 		}
+		missing = append(missing, id)
 	}
 
-	return "", fmt.Errorf("no auto-scaling group found with instance id: %s", id)
+	for i := 0; i < len(missing); i += describeBatchSize {
+		batch := missing[i:]
+		if len(batch) > describeBatchSize {
+			batch = batch[:describeBatchSize]
+		}
+		glog.V(4).Infof("describing a batch of %d instances", len(batch))
+
+		instances, err := r.describeInstanceBatch(batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range instances {
+			id := aws.StringValue(x.InstanceId)
+			r.instances[id] = x
+			list[id] = x
+		}
+	}
+
+	return list, nil
 }
 
-func (r awsClient) isInstanceTerminated(id string) (bool, error) {
-	glog.V(10).Infof("checking if instance id: %s is terminated", id)
+// describeInstanceBatch describes the instances by id; as the api refuses the whole call when any of
+// the ids no longer exist, or are not instance ids at all, such as a member added by hand, it falls
+// back to the instance id filter, which ignores them
+func (r *awsClient) describeInstanceBatch(ids []string) ([]*ec2.Instance, error) {
+	list, err := r.describeInstancePages(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)})
+	if e, ok := err.(awserr.Error); ok && (e.Code() == "InvalidInstanceID.NotFound" || e.Code() == "InvalidInstanceID.Malformed") {
+		glog.V(4).Infof("some of the instances no longer exist or are malformed, falling back to the instance id filter, error: %s", e.Code())
 
-	instance, err := r.compute.DescribeInstances(&ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("instance-id"),
-				Values: []*string{aws.String(id)},
+		return r.describeInstancePages(&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("instance-id"),
+					Values: aws.StringSlice(ids),
+				},
 			},
+		})
+	}
+
+	return list, err
+}
+
+// describeInstancePages retrieves all the instances matching the input
+func (r *awsClient) describeInstancePages(input *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
+	var list []*ec2.Instance
+	err := r.compute.DescribeInstancesPages(input, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, x := range page.Reservations {
+			list = append(list, x.Instances...)
+		}
+		return true
+	})
+
+	return list, err
+}
+
+// resetCache forgets the instances described in a previous run
+func (r *awsClient) resetCache() {
+	r.instances = make(map[string]*ec2.Instance, 0)
+}
+
+// getInstanceTag retrieves the value of the tag on the instance, empty if not set
+func (r *awsClient) getInstanceTag(id, key string) (string, error) {
+	var value string
+	err := r.compute.DescribeTagsPages(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{aws.String(id)}},
+			{Name: aws.String("key"), Values: []*string{aws.String(key)}},
 		},
+	}, func(page *ec2.DescribeTagsOutput, last bool) bool {
+		if len(page.Tags) > 0 {
+			value = aws.StringValue(page.Tags[0].Value)
+			return false
+		}
+		return true
+	})
+
+	return value, err
+}
+
+// getAutoScalingGroupByName retrieves the auto-scaling group by name
+func (r *awsClient) getAutoScalingGroupByName(name string) (*autoscaling.Group, error) {
+	var group *autoscaling.Group
+	err := r.asg.DescribeAutoScalingGroupsPages(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(name)},
+	}, func(page *autoscaling.DescribeAutoScalingGroupsOutput, last bool) bool {
+		for _, gp := range page.AutoScalingGroups {
+			if aws.StringValue(gp.AutoScalingGroupName) == name {
+				group = gp
+				return false
+			}
+		}
+		return true
 	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	if group == nil {
+		return nil, fmt.Errorf("no auto-scaling group %s found", name)
+	}
+
+	return group, nil
+}
+
+// newAwsProvider creates a provider from the auto-scaling group the instance is in
+func newAwsProvider() (*awsProvider, error) {
+	return newAwsProviderWith(newMetadataClient(config.metadataURL), newAwsClient)
+}
 
-	if len(instance.Reservations) <= 0 {
-		glog.Warningf("no instance %s found in the region", id)
-		return false, nil
+// newAwsProviderWith creates the provider from the metadata service, creating the aws client for
+// the region the instance is in
+func newAwsProviderWith(metadata metadataService, newClient func(string) (*awsClient, error)) (*awsProvider, error) {
+	// step: retrieve this instances identity
+	identity, err := metadata.getInstanceIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the instance identity, error: %s", err)
+	}
+
+	// step: create a aws client
+	client, err := newClient(identity.Region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a aws client, error: %s", err)
 	}
 
-	status := *instance.Reservations[0].Instances[0].State.Name
-	glog.V(3).Infof("instance status of %s: %s", id, status)
+	return &awsProvider{
+		client:    client,
+		metadata:  metadata,
+		identity:  identity,
+		groupName: config.groupName,
+	}, nil
+}
+
+// self retrieves the peer for the running instance
+func (r *awsProvider) self() (*peer, error) {
+	return &peer{
+		Name:           r.identity.InstanceID,
+		PrivateIP:      r.identity.LocalIP,
+		PrivateDNSName: r.identity.PrivateDNSName,
+		Zone:           r.identity.AvailabilityZone,
+		Healthy:        true,
+	}, nil
+}
+
+// group retrieves the name of the auto-scaling group when it has not been set, reading the group tag
+// from the instance metadata, then the ec2 api, falling back to searching the auto-scaling instances
+func (r *awsProvider) group() (string, error) {
+	if r.groupName != "" {
+		return r.groupName, nil
+	}
+	id := r.identity.InstanceID
+	glog.Infof("etcd auto-scaling group not set, using instance id %s for search", id)
 
-	if status != "terminated" {
-		return false, nil
+	// step: the tag is in the metadata when the instance allows tags in the metadata
+	name, err := r.metadata.getInstanceTag(groupNameTag)
+	if err != nil {
+		glog.V(3).Infof("failed to read the group tag from the metadata, error: %s", err)
+	}
+	// step: else look up the tag on our instance
+	if name == "" {
+		if name, err = r.client.getInstanceTag(id, groupNameTag); err != nil {
+			glog.V(3).Infof("failed to read the group tag via the ec2 api, error: %s", err)
+		}
 	}
+	// step: else search the auto-scaling instances
+	if name == "" {
+		if name, err = r.client.getAutoScalingGroupWithInstanceID(id); err != nil {
+			return "", err
+		}
+	}
+	glog.Infof("found instance id: %s in the group: %s", id, name)
+	r.groupName = name
 
-	return true, nil
+	return r.groupName, nil
 }
 
-func (r *awsClient) getAutoScalingInstances(name string) ([]*ec2.Instance, error) {
-	glog.V(10).Infof("retrieving the instance from auto-scaling group: %s", name)
-	var list []*ec2.Instance
+// peers retrieves the instances in the auto-scaling group
+func (r *awsProvider) peers() ([]*peer, error) {
+	if _, err := r.group(); err != nil {
+		return nil, err
+	}
 
-	// step: find the auto-scaling group
-	group, err := r.getAutoScalingGroupByName(name)
+	glog.Infof("retrieving the instances from the group: %s", r.groupName)
+	group, err := r.client.getAutoScalingGroupByName(r.groupName)
 	if err != nil {
-		return list, err
+		return nil, err
 	}
 
-	glog.V(4).Infof("found %d instances in group: %s", len(group.Instances), name)
+	glog.V(4).Infof("found %d instances in group: %s", len(group.Instances), r.groupName)
 
-	// step: iterate the auto-scaling instance id's
+	// step: grab the instance details, starting the run with a fresh cache
+	r.client.resetCache()
+	var ids []string
 	for _, i := range group.Instances {
-		glog.V(5).Infof("group: %s, instance: %s, status: %s", name, *i.InstanceId, *i.HealthStatus)
+		ids = append(ids, aws.StringValue(i.InstanceId))
+	}
+	instances, err := r.client.describeInstances(ids)
+	if err != nil {
+		return nil, err
+	}
 
-		if *i.HealthStatus != "Healthy" {
-			glog.Warningf("the instance %s, status: %s skipping as member", *i.InstanceId, *i.HealthStatus)
-			continue
-		}
+	var list []*peer
+	for _, i := range group.Instances {
+		glog.V(5).Infof("group: %s, instance: %s, status: %s", r.groupName, *i.InstanceId, *i.HealthStatus)
 
-		// step: grab the instance details
-		instance, err := r.compute.DescribeInstances(&ec2.DescribeInstancesInput{
-			Filters: []*ec2.Filter{
-				{
-					Name:   aws.String("instance-id"),
-					Values: []*string{i.InstanceId},
-				},
-			},
-		})
-		if err != nil {
-			return nil, err
-		}
-		if len(instance.Reservations[0].Instances) <= 0 {
+		instance, found := instances[*i.InstanceId]
+		if !found {
 			glog.Warningf("the instance id: %s was not found", *i.InstanceId)
 			continue
 		}
+		glog.V(10).Infof("instance: %s, status: %s", *instance.InstanceId, *instance.State.Name)
 
-		// step: bypass any instances which are not running
-		i := instance.Reservations[0].Instances[0]
-		glog.V(10).Infof("instance: %s, status: %s", *i.InstanceId, *i.State.Name)
-		if *i.State.Name != "running" {
-			glog.Warningf("skipping instance: %s as the status is not running", *i.InstanceId)
-			continue
-		}
-
-		list = append(list, i)
+		p := newInstancePeer(instance)
+		p.Healthy = p.Healthy && *i.HealthStatus == "Healthy"
+		list = append(list, p)
 	}
 
 	return list, nil
 }
 
-func (r *awsClient) getAutoScalingGroupByName(name string) (*autoscaling.Group, error) {
-	groups, err := r.asg.DescribeAutoScalingGroups(nil)
+// desiredCapacity retrieves the desired capacity of the auto-scaling group
+func (r *awsProvider) desiredCapacity() (int, error) {
+	name, err := r.group()
+	if err != nil {
+		return 0, err
+	}
+	group, err := r.client.getAutoScalingGroupByName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(aws.Int64Value(group.DesiredCapacity)), nil
+}
+
+// describe retrieves the instances by id, any instances which no longer exist are absent
+func (r *awsProvider) describe(names []string) (map[string]*peer, error) {
+	instances, err := r.client.describeInstances(names)
 	if err != nil {
 		return nil, err
 	}
-	for _, gp := range groups.AutoScalingGroups {
-		if *gp.AutoScalingGroupName == name {
-			return gp, nil
+
+	list := make(map[string]*peer, 0)
+	for _, id := range names {
+		instance, found := instances[id]
+		if !found {
+			glog.Warningf("no instance %s found in the region", id)
+			continue
 		}
+		glog.V(3).Infof("instance status of %s: %s", id, *instance.State.Name)
+
+		list[id] = newInstancePeer(instance)
+	}
+
+	return list, nil
+}
+
+// newInstancePeer converts the instance to a peer, healthy if the instance is running
+func newInstancePeer(instance *ec2.Instance) *peer {
+	p := &peer{
+		Name:           *instance.InstanceId,
+		PrivateIP:      aws.StringValue(instance.PrivateIpAddress),
+		PrivateDNSName: aws.StringValue(instance.PrivateDnsName),
+		Healthy:        *instance.State.Name == "running",
+		State:          *instance.State.Name,
+	}
+	if instance.Placement != nil {
+		p.Zone = aws.StringValue(instance.Placement.AvailabilityZone)
 	}
 
-	return nil, fmt.Errorf("no auto-scaling group %s found", name)
+	return p
 }
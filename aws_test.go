@@ -14,3 +14,413 @@ limitations under the License.
 */
 
 package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeInstance is an instance in the fake aws
+type fakeInstance struct {
+	// the id of the instance
+	id string
+	// the private ip address
+	ip string
+	// the ec2 state, i.e. running, stopped or terminated
+	state string
+	// the auto-scaling health status
+	health string
+	// the auto-scaling group the instance is in, empty if none
+	group string
+}
+
+// fakeAWS is an in-process stand-in for the auto-scaling groups and instances, scripted by the tests
+type fakeAWS struct {
+	// the desired capacity of the groups, keyed by name
+	groups map[string]int
+	// the instances, keyed by id
+	instances map[string]*fakeInstance
+	// tagged exposes the group name tag via the ec2 api
+	tagged bool
+	// the number of calls made to each api
+	calls map[string]int
+	// the largest number of instance ids in a single describe call
+	largestBatch int
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{
+		groups:    make(map[string]int, 0),
+		instances: make(map[string]*fakeInstance, 0),
+		calls:     make(map[string]int, 0),
+	}
+}
+
+// addGroup creates an auto-scaling group
+func (r *fakeAWS) addGroup(name string, desired int) {
+	r.groups[name] = desired
+}
+
+// launch starts an instance in the group
+func (r *fakeAWS) launch(group, id, ip string) {
+	r.instances[id] = &fakeInstance{id: id, ip: ip, state: "running", health: "Healthy", group: group}
+}
+
+// stop stops the instance, which the group then considers unhealthy
+func (r *fakeAWS) stop(id string) {
+	r.instances[id].state = "stopped"
+	r.instances[id].health = "Unhealthy"
+}
+
+// start starts a stopped instance, which comes back with a new address
+func (r *fakeAWS) start(id, ip string) {
+	r.instances[id].state = "running"
+	r.instances[id].health = "Healthy"
+	r.instances[id].ip = ip
+}
+
+// terminate terminates the instance, removing it from the group
+func (r *fakeAWS) terminate(id string) {
+	r.instances[id].state = "terminated"
+	r.instances[id].group = ""
+}
+
+// forget removes the instance entirely, as once it has aged out of the ec2 api
+func (r *fakeAWS) forget(id string) {
+	delete(r.instances, id)
+}
+
+// sortedInstances returns the instances sorted by id
+func (r *fakeAWS) sortedInstances() []*fakeInstance {
+	var list []*fakeInstance
+	for _, x := range r.instances {
+		list = append(list, x)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	return list
+}
+
+// fakeAutoScaling serves the auto-scaling api from the fake, any calls not implemented panic via the
+// embedded interface
+type fakeAutoScaling struct {
+	autoscalingiface.AutoScalingAPI
+	fake *fakeAWS
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroupsPages(input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool) error {
+	r := f.fake
+	r.calls["DescribeAutoScalingGroups"]++
+	var names []string
+	for name := range r.groups {
+		if len(input.AutoScalingGroupNames) <= 0 || containedIn(name, aws.StringValueSlice(input.AutoScalingGroupNames)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// step: a page per group, to exercise the pagination
+	for i, name := range names {
+		group := &autoscaling.Group{
+			AutoScalingGroupName: aws.String(name),
+			DesiredCapacity:      aws.Int64(int64(r.groups[name])),
+		}
+		for _, x := range r.sortedInstances() {
+			if x.group == name {
+				group.Instances = append(group.Instances, &autoscaling.Instance{
+					InstanceId:   aws.String(x.id),
+					HealthStatus: aws.String(x.health),
+				})
+			}
+		}
+		page := &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{group}}
+		if !fn(page, i == len(names)-1) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingInstancesPages(input *autoscaling.DescribeAutoScalingInstancesInput, fn func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool) error {
+	r := f.fake
+	r.calls["DescribeAutoScalingInstances"]++
+	page := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	for _, id := range aws.StringValueSlice(input.InstanceIds) {
+		if x, found := r.instances[id]; found && x.group != "" {
+			page.AutoScalingInstances = append(page.AutoScalingInstances, &autoscaling.InstanceDetails{
+				InstanceId:           aws.String(x.id),
+				AutoScalingGroupName: aws.String(x.group),
+			})
+		}
+	}
+	fn(page, true)
+
+	return nil
+}
+
+// fakeEC2 serves the ec2 api from the fake, any calls not implemented panic via the embedded interface
+type fakeEC2 struct {
+	ec2iface.EC2API
+	fake *fakeAWS
+}
+
+func (f *fakeEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	r := f.fake
+	r.calls["DescribeInstances"]++
+	ids := aws.StringValueSlice(input.InstanceIds)
+	if len(ids) > 0 {
+		// step: as the api does, refuse the call if any of the instances are malformed or do not exist
+		for _, id := range ids {
+			if !strings.HasPrefix(id, "i-") {
+				return awserr.New("InvalidInstanceID.Malformed", fmt.Sprintf("invalid id: \"%s\"", id), nil)
+			}
+			if _, found := r.instances[id]; !found {
+				return awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("the instance id '%s' does not exist", id), nil)
+			}
+		}
+	}
+	for _, x := range input.Filters {
+		if aws.StringValue(x.Name) == "instance-id" {
+			ids = aws.StringValueSlice(x.Values)
+		}
+	}
+	if len(ids) > r.largestBatch {
+		r.largestBatch = len(ids)
+	}
+
+	var list []*ec2.Instance
+	for _, id := range ids {
+		x, found := r.instances[id]
+		if !found {
+			continue
+		}
+		list = append(list, &ec2.Instance{
+			InstanceId:       aws.String(x.id),
+			PrivateIpAddress: aws.String(x.ip),
+			PrivateDnsName:   aws.String("ip-" + x.ip + ".internal"),
+			State:            &ec2.InstanceState{Name: aws.String(x.state)},
+			Placement:        &ec2.Placement{AvailabilityZone: aws.String("eu-west-1a")},
+		})
+	}
+
+	// step: a page per instance, to exercise the pagination
+	for i, x := range list {
+		page := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{x}}}}
+		if !fn(page, i == len(list)-1) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeEC2) DescribeTagsPages(input *ec2.DescribeTagsInput, fn func(*ec2.DescribeTagsOutput, bool) bool) error {
+	r := f.fake
+	r.calls["DescribeTags"]++
+	page := &ec2.DescribeTagsOutput{}
+	if r.tagged {
+		var id, key string
+		for _, x := range input.Filters {
+			switch aws.StringValue(x.Name) {
+			case "resource-id":
+				id = aws.StringValue(x.Values[0])
+			case "key":
+				key = aws.StringValue(x.Values[0])
+			}
+		}
+		if x, found := r.instances[id]; found && x.group != "" && key == groupNameTag {
+			page.Tags = append(page.Tags, &ec2.TagDescription{Key: aws.String(key), Value: aws.String(x.group)})
+		}
+	}
+	fn(page, true)
+
+	return nil
+}
+
+// fakeMetadataService is an in-process stand-in for the instance metadata
+type fakeMetadataService struct {
+	// the identity of the instance
+	identity *awsIdentity
+	// the tags exposed to the metadata
+	tags map[string]string
+}
+
+func (r *fakeMetadataService) getInstanceIdentity() (*awsIdentity, error) {
+	if r.identity == nil {
+		return nil, fmt.Errorf("the metadata service is not available")
+	}
+
+	return r.identity, nil
+}
+
+func (r *fakeMetadataService) getInstanceTag(key string) (string, error) {
+	return r.tags[key], nil
+}
+
+// newFakeProvider creates an aws provider, running as the instance, backed by the fakes
+func newFakeProvider(fake *fakeAWS, id string, tags map[string]string) (*awsProvider, error) {
+	metadata := &fakeMetadataService{tags: tags}
+	if x, found := fake.instances[id]; found {
+		metadata.identity = &awsIdentity{
+			InstanceID:       x.id,
+			Region:           "eu-west-1",
+			LocalIP:          x.ip,
+			PrivateDNSName:   "ip-" + x.ip + ".internal",
+			AvailabilityZone: "eu-west-1a",
+		}
+	}
+
+	return newAwsProviderWith(metadata, func(region string) (*awsClient, error) {
+		if region != "eu-west-1" {
+			return nil, fmt.Errorf("unexpected region: %s", region)
+		}
+		return &awsClient{asg: &fakeAutoScaling{fake: fake}, compute: &fakeEC2{fake: fake}, instances: make(map[string]*ec2.Instance, 0)}, nil
+	})
+}
+
+func TestAwsProviderGroup(t *testing.T) {
+	cases := []struct {
+		name     string
+		tags     map[string]string
+		tagged   bool
+		instance string
+		expected string
+		calls    map[string]int
+	}{
+		{
+			name:     "metadata tags",
+			tags:     map[string]string{groupNameTag: "etcd"},
+			instance: "i-1",
+			expected: "etcd",
+			calls:    map[string]int{"DescribeTags": 0, "DescribeAutoScalingInstances": 0},
+		},
+		{
+			name:     "ec2 tags",
+			tagged:   true,
+			instance: "i-1",
+			expected: "etcd",
+			calls:    map[string]int{"DescribeTags": 1, "DescribeAutoScalingInstances": 0},
+		},
+		{
+			name:     "auto-scaling instances",
+			instance: "i-1",
+			expected: "etcd",
+			calls:    map[string]int{"DescribeTags": 1, "DescribeAutoScalingInstances": 1},
+		},
+		{
+			name:     "not in a group",
+			instance: "i-detached",
+		},
+	}
+	for _, c := range cases {
+		fake := newFakeAWS()
+		fake.tagged = c.tagged
+		fake.addGroup("other", 1)
+		fake.addGroup("etcd", 1)
+		fake.launch("other", "i-0", "127.0.0.10")
+		fake.launch("etcd", "i-1", "127.0.0.11")
+		fake.launch("", "i-detached", "127.0.0.12")
+
+		provider, err := newFakeProvider(fake, c.instance, c.tags)
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		name, err := provider.group()
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("case %s, expected an error, got the group: %s", c.name, name)
+			}
+			continue
+		}
+		if err != nil || name != c.expected {
+			t.Errorf("case %s, expected the group: %s, got: %s, error: %v", c.name, c.expected, name, err)
+		}
+		for api, count := range c.calls {
+			if fake.calls[api] != count {
+				t.Errorf("case %s, expected %d calls to %s, got %d", c.name, count, api, fake.calls[api])
+			}
+		}
+		if fake.calls["DescribeAutoScalingGroups"] != 0 {
+			t.Errorf("case %s, the group should not be found by scanning the auto-scaling groups", c.name)
+		}
+	}
+}
+
+func TestAwsProviderPeers(t *testing.T) {
+	defer func(name string) { config.groupName = name }(config.groupName)
+	config.groupName = "etcd"
+
+	fake := newFakeAWS()
+	fake.addGroup("etcd", 250)
+	for i := 0; i < 250; i++ {
+		fake.launch("etcd", fmt.Sprintf("i-%03d", i), fmt.Sprintf("10.0.%d.%d", i/100, i%100))
+	}
+	fake.stop("i-001")
+
+	provider, err := newFakeProvider(fake, "i-000", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	peers, err := provider.peers()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(peers) != 250 {
+		t.Errorf("expected 250 peers, got %d", len(peers))
+	}
+	if fake.calls["DescribeInstances"] != 3 || fake.largestBatch > describeBatchSize {
+		t.Errorf("expected the instances described in 3 batches, got %d calls, largest: %d", fake.calls["DescribeInstances"], fake.largestBatch)
+	}
+	if healthy := healthyPeers(peers); len(healthy) != 249 {
+		t.Errorf("expected the stopped instance to be unhealthy, got %d healthy", len(healthy))
+	}
+	if capacity, err := provider.desiredCapacity(); err != nil || capacity != 250 {
+		t.Errorf("expected the desired capacity of 250, got: %d, error: %v", capacity, err)
+	}
+}
+
+func TestAwsProviderDescribe(t *testing.T) {
+	defer func(name string) { config.groupName = name }(config.groupName)
+	config.groupName = "etcd"
+
+	fake := newFakeAWS()
+	fake.addGroup("etcd", 2)
+	fake.launch("etcd", "i-1", "127.0.0.11")
+	fake.launch("etcd", "i-2", "127.0.0.12")
+	fake.launch("etcd", "i-3", "127.0.0.13")
+	fake.terminate("i-2")
+	fake.forget("i-3")
+
+	provider, err := newFakeProvider(fake, "i-1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := provider.peers(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	calls := fake.calls["DescribeInstances"]
+
+	// step: the terminated instance is described, the forgotten and hand added ones absent
+	instances, err := provider.describe([]string{"i-1", "i-2", "i-3", "etcd0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(instances) != 2 || instances["i-2"] == nil || instances["i-2"].State != "terminated" {
+		t.Errorf("expected the running and terminated instances, got: %v", instances)
+	}
+	// step: i-1 is served from the cache, the batch falling back to the filter
+	if fake.calls["DescribeInstances"]-calls != 2 {
+		t.Errorf("expected 2 calls to describe the instances, got %d", fake.calls["DescribeInstances"]-calls)
+	}
+}
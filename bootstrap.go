@@ -0,0 +1,139 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// bootstrapCluster decides, while holding the bootstrap lock if any, whether we are bootstrapping a
+// new cluster or another node has formed one, returning the peers and the cluster state
+func bootstrapCluster(self *peer, peers []*peer) ([]*peer, string, error) {
+	lock, err := newBootstrapLocker(self.Name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	state := "new"
+	err = withLock(lock, func() error {
+		// step: check again, a cluster may have formed while we waited for the lock
+		if lock != nil && isClusterAvailable(peers) {
+			state = "existing"
+			return nil
+		}
+		if !config.bootstrapWait {
+			return nil
+		}
+
+		// step: wait for the whole group before bootstrapping
+		var existing bool
+		if peers, existing, err = waitForBootstrap(self, lock); err != nil {
+			return err
+		}
+		if existing {
+			state = "existing"
+		}
+
+		return nil
+	})
+
+	return peers, state, err
+}
+
+// waitForBootstrap waits for the group to reach its desired capacity with every instance running,
+// so every node bootstrapping the cluster derives the same initial members. It returns early,
+// flagging the cluster as existing, should a cluster form while we are waiting, and fails should
+// the bootstrap lock, if any, be lost
+func waitForBootstrap(self *peer, lock locker) ([]*peer, bool, error) {
+	glog.Infof("waiting up to %s for the group to be ready to bootstrap", config.bootstrapTimeout)
+	deadline := time.Now().Add(config.bootstrapTimeout)
+
+	for {
+		group, err := discovery.peers()
+		if err != nil {
+			glog.Warningf("failed to retrieve the peers in the group, error: %s", err)
+		} else {
+			desired, err := discovery.desiredCapacity()
+			if err != nil {
+				glog.Warningf("failed to retrieve the desired capacity of the group, error: %s", err)
+			} else if reason := isBootstrapReady(self, group, desired); reason == "" {
+				glog.Infof("the group has reached its desired capacity of %d, bootstrapping", desired)
+				return group, false, nil
+			} else {
+				glog.Infof("the group is not ready to bootstrap, %s", reason)
+			}
+
+			// step: has a cluster formed in the meantime?
+			if peers := healthyPeers(group); isClusterAvailable(peers) {
+				glog.Infof("a cluster has formed while waiting, joining the existing cluster")
+				return peers, true, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, false, fmt.Errorf("the group was not ready to bootstrap within %s", config.bootstrapTimeout)
+		}
+		if lock != nil {
+			if err := lock.held(); err != nil {
+				return nil, false, fmt.Errorf("the bootstrap lock was lost while waiting, error: %s", err)
+			}
+		}
+		if err := sleep(config.bootstrapInterval); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// isBootstrapReady checks the group is at its desired capacity, every peer is healthy and we are
+// one of them, returning the reason if not
+func isBootstrapReady(self *peer, group []*peer, desired int) string {
+	if desired <= 0 {
+		return "the group has no desired capacity"
+	}
+	if len(group) != desired {
+		return fmt.Sprintf("the group has %d of the desired %d instances", len(group), desired)
+	}
+	for _, p := range group {
+		if !p.Healthy {
+			return fmt.Sprintf("the instance %s is not healthy, state: %s", p.Name, p.State)
+		}
+	}
+	if findPeer(self.Name, group) == nil {
+		return fmt.Sprintf("this node %s is not in the group", self.Name)
+	}
+
+	return ""
+}
+
+// isClusterAvailable checks if any of the peers answer as members of a cluster
+func isClusterAvailable(peers []*peer) bool {
+	if len(peers) <= 0 {
+		return false
+	}
+	client, err := newEtcdClient(getEtcdEndpoints(peers))
+	if err != nil {
+		glog.Warningf("failed to create an etcd client, error: %s", err)
+		return false
+	}
+	defer client.close()
+
+	_, err = client.listMembers()
+
+	return err == nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIsBootstrapReady(t *testing.T) {
+	self := &peer{Name: "i-1"}
+	group := func(healthy ...bool) []*peer {
+		var list []*peer
+		for i, h := range healthy {
+			list = append(list, &peer{Name: fmt.Sprintf("i-%d", i+1), Healthy: h, State: "running"})
+		}
+		return list
+	}
+	cs := []struct {
+		Group   []*peer
+		Desired int
+		Reason  string
+	}{
+		{Group: group(true, true, true), Desired: 3},
+		{Group: group(true, true), Desired: 3, Reason: "2 of the desired 3"},
+		{Group: group(true, false, true), Desired: 3, Reason: "i-2 is not healthy"},
+		{Group: group(true, true, true), Desired: 0, Reason: "no desired capacity"},
+		{Group: group(true, true, true)[1:], Desired: 2, Reason: "not in the group"},
+	}
+	for i, c := range cs {
+		reason := isBootstrapReady(self, c.Group, c.Desired)
+		if c.Reason == "" && reason != "" {
+			t.Errorf("case %d, expected the group to be ready, got: %s", i, reason)
+		}
+		if c.Reason != "" && !strings.Contains(reason, c.Reason) {
+			t.Errorf("case %d, expected the reason: %s, got: %s", i, c.Reason, reason)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// certificateSpec describes a certificate to issue for the node
+type certificateSpec struct {
+	// kind is the type of certificate, i.e. peer or server, also used as the signer profile
+	kind string
+	// dnsNames is the dns subject alternative names
+	dnsNames []string
+	// ips is the ip subject alternative names
+	ips []net.IP
+}
+
+// certificateSigner signs a certificate request for the node
+type certificateSigner interface {
+	// sign signs the certificate request, returning the pem encoded certificate
+	sign(spec *certificateSpec, csr []byte) ([]byte, error)
+	// authority returns the pem encoded certificate authority
+	authority() ([]byte, error)
+}
+
+// localSigner signs the certificates with a local certificate authority
+type localSigner struct {
+	// the certificate authority
+	ca *x509.Certificate
+	// the pem encoded certificate authority
+	caPEM []byte
+	// the private key of the certificate authority
+	key crypto.Signer
+}
+
+// remoteSigner signs the certificates via a cfssl compatible signing endpoint
+type remoteSigner struct {
+	// the base url of the signing endpoint
+	url string
+	// the http client
+	client *http.Client
+}
+
+// issueCertificates writes the peer and server certificates for the node into the tls directory,
+// reissuing them when they are missing, about to expire or the addresses of the node have changed
+func issueCertificates(self *peer) error {
+	signer, err := newCertificateSigner()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.tlsDir, 0755); err != nil {
+		return err
+	}
+
+	for _, spec := range getCertificateSpecs(self) {
+		certFile := filepath.Join(config.tlsDir, spec.kind+".pem")
+		keyFile := filepath.Join(config.tlsDir, spec.kind+"-key.pem")
+
+		if !needsCertificate(certFile, keyFile, spec) {
+			glog.V(3).Infof("the %s certificate: %s is up to date", spec.kind, certFile)
+			continue
+		}
+		glog.Infof("issuing the %s certificate: %s, dns: %s, ips: %s", spec.kind, certFile,
+			strings.Join(spec.dnsNames, ","), spec.ips)
+
+		// step: generate a key and the certificate request
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: self.Name},
+			DNSNames:    spec.dnsNames,
+			IPAddresses: spec.ips,
+		}, key)
+		if err != nil {
+			return err
+		}
+
+		// step: get the request signed
+		certificate, err := signer.sign(spec, csr)
+		if err != nil {
+			return fmt.Errorf("failed to sign the %s certificate, error: %s", spec.kind, err)
+		}
+
+		encoded, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		// step: write the key before the certificate, a mismatched pair is reissued on the next run
+		if err := writeAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}), 0600, -1, -1); err != nil {
+			return err
+		}
+		if err := writeAtomic(certFile, certificate, 0644, -1, -1); err != nil {
+			return err
+		}
+	}
+
+	// step: write out the certificate authority
+	ca, err := signer.authority()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the certificate authority, error: %s", err)
+	}
+
+	return writeAtomic(filepath.Join(config.tlsDir, "ca.pem"), ca, 0644, -1, -1)
+}
+
+// getCertificateSpecs returns the certificates required by the node; the private dns name and ip
+// address are always included, regardless of the addressing mode
+func getCertificateSpecs(self *peer) []*certificateSpec {
+	var names []string
+	var ips []net.IP
+	if self.PrivateDNSName != "" {
+		names = append(names, self.PrivateDNSName)
+	}
+	if ip := net.ParseIP(self.PrivateIP); ip != nil {
+		ips = append(ips, ip)
+	}
+
+	return []*certificateSpec{
+		{kind: "peer", dnsNames: names, ips: ips},
+		{kind: "server", dnsNames: append(names, "localhost"), ips: append(ips, net.ParseIP("127.0.0.1"))},
+	}
+}
+
+// needsCertificate checks if the certificate is missing, does not match its key, is expiring or the
+// names have changed
+func needsCertificate(filename, keyFile string, spec *certificateSpec) bool {
+	if _, err := tls.LoadX509KeyPair(filename, keyFile); err != nil {
+		glog.Infof("the %s certificate and key are not a valid pair, reissuing, error: %s", spec.kind, err)
+		return true
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return true
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return true
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	if time.Now().Add(config.tlsRenewBefore).After(certificate.NotAfter) {
+		glog.Infof("the %s certificate expires at %s, renewing", spec.kind, certificate.NotAfter)
+		return true
+	}
+
+	expected := append([]string{}, spec.dnsNames...)
+	for _, x := range spec.ips {
+		expected = append(expected, x.String())
+	}
+	actual := append([]string{}, certificate.DNSNames...)
+	for _, x := range certificate.IPAddresses {
+		actual = append(actual, x.String())
+	}
+	sort.Strings(expected)
+	sort.Strings(actual)
+
+	return strings.Join(expected, ",") != strings.Join(actual, ",")
+}
+
+// newCertificateSigner creates the signer from the configuration
+func newCertificateSigner() (certificateSigner, error) {
+	if config.tlsSignerURL != "" {
+		return &remoteSigner{
+			url:    strings.TrimRight(config.tlsSignerURL, "/"),
+			client: &http.Client{Timeout: time.Duration(10) * time.Second},
+		}, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(config.tlsCACert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(config.tlsCAKey)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(caPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate authority, error: %s", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("the certificate authority key is not supported")
+	}
+
+	return &localSigner{ca: ca, caPEM: caPEM, key: key}, nil
+}
+
+// sign signs the certificate request with the local certificate authority
+func (r *localSigner) sign(spec *certificateSpec, csr []byte) ([]byte, error) {
+	request, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               request.Subject,
+		DNSNames:              request.DNSNames,
+		IPAddresses:           request.IPAddresses,
+		NotBefore:             time.Now().Add(-time.Duration(5) * time.Minute),
+		NotAfter:              time.Now().Add(config.tlsValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, r.ca, request.PublicKey, r.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), nil
+}
+
+// authority returns the local certificate authority
+func (r *localSigner) authority() ([]byte, error) {
+	return r.caPEM, nil
+}
+
+// cfsslResponse is the response from the cfssl api
+type cfsslResponse struct {
+	Success bool `json:"success"`
+	Result  struct {
+		Certificate string `json:"certificate"`
+	} `json:"result"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// sign sends the certificate request to the cfssl sign endpoint
+func (r *remoteSigner) sign(spec *certificateSpec, csr []byte) ([]byte, error) {
+	hosts := append([]string{}, spec.dnsNames...)
+	for _, x := range spec.ips {
+		hosts = append(hosts, x.String())
+	}
+
+	certificate, err := r.call("sign", map[string]interface{}{
+		"certificate_request": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		"hosts":               hosts,
+		"profile":             spec.kind,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(certificate), nil
+}
+
+// authority retrieves the certificate authority from the cfssl info endpoint
+func (r *remoteSigner) authority() ([]byte, error) {
+	certificate, err := r.call("info", map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(certificate), nil
+}
+
+// call performs a request against the cfssl api, returning the certificate in the result
+func (r *remoteSigner) call(method string, request interface{}) (string, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Post(fmt.Sprintf("%s/api/v1/cfssl/%s", r.url, method), "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	result := new(cfsslResponse)
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", fmt.Errorf("invalid response from the signer, status: %s, error: %s", resp.Status, err)
+	}
+	if !result.Success || result.Result.Certificate == "" {
+		var messages []string
+		for _, x := range result.Errors {
+			messages = append(messages, x.Message)
+		}
+		return "", fmt.Errorf("the signer refused the request, status: %s, errors: %s", resp.Status, strings.Join(messages, ", "))
+	}
+
+	return result.Result.Certificate, nil
+}
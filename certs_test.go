@@ -0,0 +1,104 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the ca key, error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Duration(24*365) * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create the ca, error: %s", err)
+	}
+	encoded, _ := x509.MarshalECPrivateKey(key)
+
+	config.tlsCACert = filepath.Join(dir, "test-ca.pem")
+	config.tlsCAKey = filepath.Join(dir, "test-ca-key.pem")
+	ioutil.WriteFile(config.tlsCACert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600)
+	ioutil.WriteFile(config.tlsCAKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}), 0600)
+}
+
+func TestIssueCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-discovery")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { config.tlsDir, config.tlsCACert, config.tlsCAKey = "", "", "" }()
+
+	newTestCA(t, dir)
+	config.tlsDir = filepath.Join(dir, "certs")
+	self := &peer{Name: "i-self", PrivateIP: "10.0.1.10", PrivateDNSName: "ip-10-0-1-10.internal"}
+
+	if err := issueCertificates(self); err != nil {
+		t.Fatalf("failed to issue the certificates, error: %s", err)
+	}
+
+	for _, spec := range getCertificateSpecs(self) {
+		filename := filepath.Join(config.tlsDir, spec.kind+".pem")
+		if needsCertificate(filename, filepath.Join(config.tlsDir, spec.kind+"-key.pem"), spec) {
+			t.Errorf("the %s certificate should be up to date", spec.kind)
+		}
+		if _, err := os.Stat(filepath.Join(config.tlsDir, spec.kind+"-key.pem")); err != nil {
+			t.Errorf("the %s key is missing, error: %s", spec.kind, err)
+		}
+	}
+
+	// step: a key which does not match the certificate should require a new certificate
+	peerKey, _ := ioutil.ReadFile(filepath.Join(config.tlsDir, "peer-key.pem"))
+	serverKey := filepath.Join(config.tlsDir, "server-key.pem")
+	serverKeyPEM, _ := ioutil.ReadFile(serverKey)
+	ioutil.WriteFile(serverKey, peerKey, 0600)
+	for _, spec := range getCertificateSpecs(self) {
+		if spec.kind == "server" && !needsCertificate(filepath.Join(config.tlsDir, "server.pem"), serverKey, spec) {
+			t.Errorf("the server certificate should be reissued when the key does not match")
+		}
+	}
+	ioutil.WriteFile(serverKey, serverKeyPEM, 0600)
+
+	// step: changing the address should require new certificates
+	self.PrivateIP = "10.0.1.11"
+	for _, spec := range getCertificateSpecs(self) {
+		if !needsCertificate(filepath.Join(config.tlsDir, spec.kind+".pem"), filepath.Join(config.tlsDir, spec.kind+"-key.pem"), spec) {
+			t.Errorf("the %s certificate should be reissued when the address changes", spec.kind)
+		}
+	}
+}
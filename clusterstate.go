@@ -0,0 +1,290 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// probeAnswered is a member of a formed cluster answering on the client port
+	probeAnswered = "answered"
+	// probeBootstrapping is etcd running but waiting for a new cluster to form
+	probeBootstrapping = "bootstrapping"
+	// probeDown is nothing listening on the client port
+	probeDown = "down"
+	// probeUnknown is a peer we could not determine the state of
+	probeUnknown = "unknown"
+)
+
+// errSplitBrain is returned when refusing to join a group running more than one cluster
+var errSplitBrain = errors.New("refusing to join the cluster, the group is running more than one")
+
+// peerProbe is the state of the etcd on a peer
+type peerProbe struct {
+	// the peer probed
+	peer *peer
+	// the status of the peer, i.e. answered, bootstrapping, down or unknown
+	status string
+	// the id of the cluster the peer is a member of, if it answered
+	clusterID string
+	// the members of the cluster, if it answered
+	members []*member
+	// the error probing the peer
+	err error
+}
+
+// stateSignals are the signals the initial cluster state is decided from
+type stateSignals struct {
+	// probes is the state of each of the peers
+	probes []*peerProbe
+	// hasData indicates the local data directory holds usable data
+	hasData bool
+	// marker is the id of the cluster we were last seen a member of
+	marker string
+}
+
+// detectClusterState works out if we are joining an existing cluster or bootstrapping a new one,
+// retrying while the signals are ambiguous rather than risk bootstrapping a second cluster
+func detectClusterState(self *peer, peers []*peer) (string, error) {
+	if config.proxyMode {
+		return "existing", nil
+	}
+	deadline := time.Now().Add(config.clusterStateTimeout)
+
+	for {
+		signals, err := getStateSignals(peers)
+		if err != nil {
+			return "", err
+		}
+		state, err := decideClusterState(signals)
+		if err == nil {
+			glog.Infof("the initial cluster state is: %s", state)
+			return state, recordClusterMarker(self, signals)
+		}
+		// step: retrying will not resolve a split brain
+		if err == errSplitBrain {
+			return "", err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("unable to decide the initial cluster state within %s, %s", config.clusterStateTimeout, err)
+		}
+		glog.Warningf("unable to decide the initial cluster state, retrying in %s, %s", config.clusterStateInterval, err)
+
+		if err := sleep(config.clusterStateInterval); err != nil {
+			return "", err
+		}
+	}
+}
+
+// decideClusterState decides the initial cluster state from the signals, only choosing new when
+// none of the peers belong to a cluster and nothing suggests one exists
+func decideClusterState(signals *stateSignals) (string, error) {
+	ids := make(map[string]bool, 0)
+	var unknown []string
+	for _, x := range signals.probes {
+		switch x.status {
+		case probeAnswered:
+			ids[x.clusterID] = true
+		case probeUnknown:
+			unknown = append(unknown, fmt.Sprintf("%s (%s)", x.peer.Name, x.err))
+		}
+	}
+
+	switch {
+	case len(ids) > 1:
+		var list []string
+		for id := range ids {
+			list = append(list, id)
+		}
+		sort.Strings(list)
+		glog.Errorf("split brain detected, the peers belong to different clusters: %s", strings.Join(list, ","))
+		if config.refuseSplitBrain {
+			return "", errSplitBrain
+		}
+		return "existing", nil
+	case len(ids) == 1:
+		return "existing", nil
+	case signals.hasData:
+		return "existing", nil
+	case signals.marker != "":
+		return "", fmt.Errorf("this node was a member of the cluster %s, but none of the peers answered", signals.marker)
+	case len(unknown) > 0:
+		return "", fmt.Errorf("unable to determine the state of the peers: %s", strings.Join(unknown, ", "))
+	}
+
+	return "new", nil
+}
+
+// getStateSignals probes the peers and gathers the local signals
+func getStateSignals(peers []*peer) (*stateSignals, error) {
+	signals := &stateSignals{
+		probes: probePeers(peers),
+		marker: store.ClusterID,
+	}
+
+	var answered []*peer
+	for _, x := range signals.probes {
+		glog.V(3).Infof("peer: %s, status: %s, cluster: %s", x.peer.Name, x.status, x.clusterID)
+		if x.status == probeAnswered {
+			answered = append(answered, x.peer)
+		}
+	}
+
+	// step: check the local data is not stale; existing data means we were part of a cluster
+	if config.dataDir != "" {
+		hasData, err := checkDataDir(config.dataDir, answered, len(answered) > 0)
+		if err != nil {
+			return nil, err
+		}
+		signals.hasData = hasData
+	}
+
+	return signals, nil
+}
+
+// recordClusterMarker persists the id of the cluster once we are a member of it
+func recordClusterMarker(self *peer, signals *stateSignals) error {
+	for _, x := range signals.probes {
+		if x.status != probeAnswered || !isSelfMember(self, x.members) {
+			continue
+		}
+		if store.ClusterID == x.clusterID {
+			return nil
+		}
+		if store.ClusterID != "" {
+			glog.Warningf("the cluster id has changed from %s to %s", store.ClusterID, x.clusterID)
+		}
+		store.ClusterID = x.clusterID
+
+		return store.save()
+	}
+
+	return nil
+}
+
+// isSelfMember checks if we are a member of the cluster, by name or our peer url if not yet started
+func isSelfMember(self *peer, members []*member) bool {
+	if findMember(self.Name, members) != nil {
+		return true
+	}
+	for _, m := range members {
+		if m.Name == "" && containedIn(getPeerURL(self.address()), m.PeerURLs) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probePeers probes the peers in parallel
+func probePeers(peers []*peer) []*peerProbe {
+	probes := make([]*peerProbe, len(peers))
+
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p *peer) {
+			defer wg.Done()
+			probes[i] = probePeer(p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	return probes
+}
+
+// probePeer works out the state of the etcd on the peer
+func probePeer(p *peer) *peerProbe {
+	probe := &peerProbe{peer: p, status: probeUnknown}
+
+	// step: is anything listening on the client port?
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(p.address(), strconv.Itoa(config.etcdClientPort)), dialTimeout)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			probe.status = probeDown
+		}
+		probe.err = err
+		return probe
+	}
+	conn.Close()
+
+	// step: ask the peer for the cluster it belongs to
+	client, err := newEtcdClient([]string{getClientURL(p.address())})
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+	defer client.close()
+
+	if probe.clusterID, probe.members, err = client.clusterMembers(); err == nil {
+		probe.status = probeAnswered
+		return probe
+	}
+	probe.err = err
+
+	// step: the client port is only served once the cluster has formed, so check the peer port
+	if bootstrapping, err := isPeerBootstrapping(p); err != nil {
+		glog.V(3).Infof("failed to retrieve the version from peer: %s, error: %s", p.Name, err)
+	} else if bootstrapping {
+		probe.status = probeBootstrapping
+	}
+
+	return probe
+}
+
+// isPeerBootstrapping checks the peer port for an etcd which is yet to decide the cluster version,
+// i.e. it is waiting for a new cluster to form
+func isPeerBootstrapping(p *peer) (bool, error) {
+	tlsConfig, err := getPeerTLSConfig()
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{
+		Timeout:   dialTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	resp, err := client.Get(getPeerURL(p.address()) + "/version")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	version := struct {
+		Cluster string `json:"etcdcluster"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return false, err
+	}
+
+	return version.Cluster == "not_decided", nil
+}
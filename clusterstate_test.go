@@ -0,0 +1,94 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestDecideClusterState(t *testing.T) {
+	answered := func(id string) *peerProbe {
+		return &peerProbe{peer: &peer{Name: "i-" + id}, status: probeAnswered, clusterID: id}
+	}
+	down := &peerProbe{peer: &peer{Name: "i-down"}, status: probeDown}
+	bootstrapping := &peerProbe{peer: &peer{Name: "i-bootstrapping"}, status: probeBootstrapping}
+	unknown := &peerProbe{peer: &peer{Name: "i-unknown"}, status: probeUnknown, err: errors.New("i/o timeout")}
+
+	defer func(refuse bool) { config.refuseSplitBrain = refuse }(config.refuseSplitBrain)
+
+	cases := []struct {
+		name     string
+		signals  *stateSignals
+		refuse   bool
+		expected string
+	}{
+		{name: "first boot", signals: &stateSignals{probes: []*peerProbe{down, down}}, expected: "new"},
+		{name: "peers bootstrapping", signals: &stateSignals{probes: []*peerProbe{down, bootstrapping}}, expected: "new"},
+		{name: "cluster answered", signals: &stateSignals{probes: []*peerProbe{answered("a"), unknown}}, expected: "existing"},
+		{name: "local data", signals: &stateSignals{probes: []*peerProbe{down}, hasData: true}, expected: "existing"},
+		{name: "different clusters", signals: &stateSignals{probes: []*peerProbe{answered("a"), answered("b")}}, expected: "existing"},
+		{name: "refuse different clusters", signals: &stateSignals{probes: []*peerProbe{answered("a"), answered("b")}}, refuse: true},
+		{name: "previously a member", signals: &stateSignals{probes: []*peerProbe{down}, marker: "a"}},
+		{name: "unreachable peers", signals: &stateSignals{probes: []*peerProbe{down, unknown}}},
+	}
+	for _, c := range cases {
+		config.refuseSplitBrain = c.refuse
+		state, err := decideClusterState(c.signals)
+		if c.expected == "" && err == nil {
+			t.Errorf("case %s, expected the state to be ambiguous, got: %s", c.name, state)
+		}
+		if c.expected != "" && (err != nil || state != c.expected) {
+			t.Errorf("case %s, expected state: %s, got: %s, error: %v", c.name, c.expected, state, err)
+		}
+	}
+}
+
+func TestProbePeer(t *testing.T) {
+	defer func(ips bool, scheme string, client, peer int) {
+		config.privateIPs, config.etcdPeerScheme, config.etcdClientPort, config.etcdPeerPort = ips, scheme, client, peer
+	}(config.privateIPs, config.etcdPeerScheme, config.etcdClientPort, config.etcdPeerPort)
+	config.privateIPs = true
+	config.etcdPeerScheme = "http"
+
+	// step: a closed port is nothing listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, error: %s", err)
+	}
+	config.etcdClientPort = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	if probe := probePeer(&peer{Name: "i-down", PrivateIP: "127.0.0.1"}); probe.status != probeDown {
+		t.Errorf("expected the peer to be down, got: %s, error: %v", probe.status, probe.err)
+	}
+
+	// step: the peer port reports the cluster version is not decided while bootstrapping
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"etcdserver":"3.5.13","etcdcluster":"not_decided"}`))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	config.etcdPeerPort, _ = strconv.Atoi(port)
+
+	if bootstrapping, err := isPeerBootstrapping(&peer{Name: "i-new", PrivateIP: "127.0.0.1"}); err != nil || !bootstrapping {
+		t.Errorf("expected the peer to be bootstrapping, error: %v", err)
+	}
+}
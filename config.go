@@ -18,12 +18,34 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // discoveryConfig is the configuration for the service
 type discoveryConfig struct {
 	// environmentFile is the file to write the environment variables
 	environmentFile string
+	// outputs is a list of format:path outputs to write the discovery result to
+	outputs []*outputSpec
+	// outputList is the raw list of outputs from the command line
+	outputList []string
+	// outputMode is the file mode of the outputs
+	outputMode os.FileMode
+	// outputModeValue is the octal file mode from the command line
+	outputModeValue string
+	// outputOwner is the user:group owning the outputs
+	outputOwner string
+	// outputUID is the uid owning the outputs, -1 to leave unchanged
+	outputUID int
+	// outputGID is the gid owning the outputs, -1 to leave unchanged
+	outputGID int
+	// outputBackup keeps a copy of the previous output as .bak when it changes
+	outputBackup bool
+	// unchangedExitCode is the exit code used when none of the outputs changed
+	unchangedExitCode int
 	// etcdPeerScheme is the protocol for the peers
 	etcdPeerScheme string
 	// clientScheme is the protocol for the clients
@@ -32,6 +54,16 @@ type discoveryConfig struct {
 	etcdClientPort int
 	// etcdPeerPort is the port for the peers
 	etcdPeerPort int
+	// etcdCAFile is the certificate authority bundle used to verify the etcd servers
+	etcdCAFile string
+	// etcdCertFile is the client certificate used to authenticate to etcd
+	etcdCertFile string
+	// etcdKeyFile is the private key for the client certificate
+	etcdKeyFile string
+	// etcdServerName overrides the server name used to verify the etcd certificates
+	etcdServerName string
+	// etcdInsecureSkipVerify disables the verification of the etcd certificates
+	etcdInsecureSkipVerify bool
 	// we should use private ip addresses for the etcd peers
 	privateIPs bool
 	// we should use private dns names for the etcd peers
@@ -40,29 +72,233 @@ type discoveryConfig struct {
 	proxyMode bool
 	// groupName is the name of the autoscaling group with the etcd masters
 	groupName string
+	// metadataURL is the base url of the instance metadata service
+	metadataURL string
+	// metadataTimeout is the time to keep retrying the metadata service, i.e. while the network comes up
+	metadataTimeout time.Duration
+	// metadataAllowV1 permits falling back to imdsv1 when the service refuses a session token
+	metadataAllowV1 bool
+	// awsMaxRetries is the number of times an aws api call is retried
+	awsMaxRetries int
+	// provider is the name of the provider used to discover the peers
+	provider string
+	// listenPeerURLs overrides the generated etcd listen peer urls
+	listenPeerURLs string
+	// listenClientURLs overrides the generated etcd listen client urls
+	listenClientURLs string
+	// advertiseClientURLs overrides the generated etcd advertised client urls
+	advertiseClientURLs string
+	// initialAdvertisePeerURLs overrides the generated etcd initial advertised peer urls
+	initialAdvertisePeerURLs string
+	// initialClusterToken overrides the cluster token derived from the group name
+	initialClusterToken string
+	// tlsDir is the directory to write the node certificates, empty disables issuing them
+	tlsDir string
+	// tlsCACert is the certificate authority used to sign the node certificates
+	tlsCACert string
+	// tlsCAKey is the private key of the certificate authority
+	tlsCAKey string
+	// tlsSignerURL is the url of a cfssl compatible api used to sign the node certificates
+	tlsSignerURL string
+	// tlsValidity is the validity of the certificates signed by the local certificate authority
+	tlsValidity time.Duration
+	// tlsRenewBefore is the time before expiry the certificates are renewed
+	tlsRenewBefore time.Duration
+	// staticName is the name of this node when using the static provider
+	staticName string
+	// staticPeers is a comma separated list of name=address peers for the static provider
+	staticPeers string
+	// staticGroup is the name of the group when using the static provider
+	staticGroup string
+	// command is the command we are running, i.e. run, daemon, plan, apply, check or iam-policy
+	command string
+	// syncInterval is the interval between reconciliations in daemon mode
+	syncInterval time.Duration
+	// syncJitter is the maximum random jitter added to the sync interval
+	syncJitter time.Duration
+	// stateDir is the directory used to persist state between runs
+	stateDir string
+	// minClusterSize is the minimum size we are permitted to shrink the cluster to
+	minClusterSize int
+	// maxRemovals is the maximum number of members removed in a single run
+	maxRemovals int
+	// maxWindowRemovals is the maximum number of members removed within the removal window
+	maxWindowRemovals int
+	// removalWindow is the window of time the maxWindowRemovals applies to
+	removalWindow time.Duration
+	// deadStates is the list of instance states considered dead
+	deadStates []string
+	// removeMissing removes members whose instances no longer exist
+	removeMissing bool
+	// removeDetached removes members whose instances exist but are no longer in the group
+	removeDetached bool
+	// joinAsLearner adds new members as non-voting learners
+	joinAsLearner bool
+	// learnerTimeout is the time a learner has to catch up before it's removed
+	learnerTimeout time.Duration
+	// bootstrapWait waits for the whole group before bootstrapping a new cluster
+	bootstrapWait bool
+	// bootstrapTimeout is the time to wait for the group to be ready for bootstrap
+	bootstrapTimeout time.Duration
+	// bootstrapInterval is the interval between checks of the group when waiting
+	bootstrapInterval time.Duration
+	// bootstrapLock is the external lock used while no cluster is available, i.e. dynamodb
+	bootstrapLock string
+	// bootstrapLockTable is the dynamodb table holding the bootstrap lock
+	bootstrapLockTable string
+	// bootstrapLockRegion is the region of the dynamodb table
+	bootstrapLockRegion string
+	// bootstrapLockEndpoint overrides the dynamodb endpoint, i.e. a local stand-in
+	bootstrapLockEndpoint string
+	// unstartedGracePeriod is the time an unstarted member without a live instance is kept
+	unstartedGracePeriod time.Duration
+	// clusterStateTimeout is the time to retry when the initial cluster state is ambiguous
+	clusterStateTimeout time.Duration
+	// clusterStateInterval is the interval between the attempts to decide the cluster state
+	clusterStateInterval time.Duration
+	// refuseSplitBrain refuses to join the cluster when the group is running more than one
+	refuseSplitBrain bool
+	// dataDir is the etcd data directory checked for stale member data
+	dataDir string
+	// staleDataDir is the action taken on stale member data, either refuse or archive
+	staleDataDir string
+	// lock serializes the membership changes with a lock held in etcd
+	lock bool
+	// lockKey is the key of the lock in etcd
+	lockKey string
+	// removalsKey is the key in etcd holding the shared history of member removals
+	removalsKey string
+	// lockTTL is the time a lock is held should the holder die
+	lockTTL time.Duration
+	// lockTimeout is the time to wait to acquire a lock
+	lockTimeout time.Duration
 }
 
 var config *discoveryConfig
 
 func init() {
-	config = new(discoveryConfig)
+	config = &discoveryConfig{
+		outputMode: 0444,
+		outputUID:  -1,
+		outputGID:  -1,
+	}
 	flag.StringVar(&config.environmentFile, "environment-file", "", "the file to write the etcd environment variables")
+	flag.Var(newMultiValue(&config.outputList), "output", "an additional output in the form format:path, where format is env, yaml, json, systemd, shell or template=FILE and a path of - is stdout (can be repeated)")
+	flag.StringVar(&config.outputModeValue, "output-mode", "0444", "the file mode, in octal, of the environment file and outputs")
+	flag.StringVar(&config.outputOwner, "output-owner", "", "the user:group, as names or ids, which should own the environment file and outputs")
+	flag.BoolVar(&config.outputBackup, "output-backup", false, "keep a copy of the previous environment file or output as .bak when it changes")
+	flag.IntVar(&config.unchangedExitCode, "unchanged-exit-code", 0, "the exit code used by the run command when none of the outputs have changed")
 	flag.StringVar(&config.etcdPeerScheme, "etcd-peer-scheme", "https", "is the protocol schema we should use for etcd peer connections")
 	flag.StringVar(&config.etcdClientScheme, "etcd-client-schema", "https", "is the protocol schema we should use for client connections")
 	flag.IntVar(&config.etcdClientPort, "etcd-client-port", 2379, "is the port the etcd client should be listening on")
 	flag.IntVar(&config.etcdPeerPort, "etcd-peer-port", 2380, "is the port the etcd peer should be listening on")
+	flag.StringVar(&config.etcdCAFile, "etcd-ca-file", "", "the certificate authority bundle used to verify the etcd servers")
+	flag.StringVar(&config.etcdCertFile, "etcd-cert-file", "", "the client certificate used to authenticate to the etcd servers")
+	flag.StringVar(&config.etcdKeyFile, "etcd-key-file", "", "the private key for the etcd client certificate")
+	flag.StringVar(&config.etcdServerName, "etcd-server-name", "", "override the server name used to verify the etcd server certificates")
+	flag.BoolVar(&config.etcdInsecureSkipVerify, "etcd-insecure-skip-verify", false, "skip the verification of the etcd server certificates")
+	flag.StringVar(&config.listenPeerURLs, "listen-peer-urls", "", "override the generated ETCD_LISTEN_PEER_URLS")
+	flag.StringVar(&config.listenClientURLs, "listen-client-urls", "", "override the generated ETCD_LISTEN_CLIENT_URLS")
+	flag.StringVar(&config.advertiseClientURLs, "advertise-client-urls", "", "override the generated ETCD_ADVERTISE_CLIENT_URLS")
+	flag.StringVar(&config.initialAdvertisePeerURLs, "initial-advertise-peer-urls", "", "override the generated ETCD_INITIAL_ADVERTISE_PEER_URLS")
+	flag.StringVar(&config.initialClusterToken, "initial-cluster-token", "", "override the ETCD_INITIAL_CLUSTER_TOKEN derived from the group name")
+	flag.StringVar(&config.tlsDir, "tls-dir", "", "the directory to write the peer and server certificates for this node, disabled if empty")
+	flag.StringVar(&config.tlsCACert, "tls-ca-cert", "", "the certificate authority used to sign the node certificates")
+	flag.StringVar(&config.tlsCAKey, "tls-ca-key", "", "the private key of the certificate authority used to sign the node certificates")
+	flag.StringVar(&config.tlsSignerURL, "tls-signer-url", "", "the url of a cfssl compatible api used to sign the node certificates")
+	flag.DurationVar(&config.tlsValidity, "tls-validity", time.Duration(8760)*time.Hour, "the validity of the certificates signed by the certificate authority")
+	flag.DurationVar(&config.tlsRenewBefore, "tls-renew-before", time.Duration(720)*time.Hour, "renew the node certificates when they are due to expire within this time")
 	flag.StringVar(&config.groupName, "scaling-group-name", "", "is the name of the aws auto-scaling group which has the etcd masters")
 	flag.BoolVar(&config.privateIPs, "private-addresses", false, "add the etcd peers using their ip addresses rather than domain names")
 	flag.BoolVar(&config.privateHostnames, "private-hostnames", true, "add the etcd peers using the dns names rather than up addresses")
 	flag.BoolVar(&config.proxyMode, "proxy-mode", false, "whether or not we are operating in etcd proxy mode")
+	flag.StringVar(&config.metadataURL, "metadata-url", "http://169.254.169.254", "the base url of the instance metadata service")
+	flag.DurationVar(&config.metadataTimeout, "metadata-timeout", time.Duration(2)*time.Minute, "the time to keep retrying the metadata service, i.e. while the network comes up at boot")
+	flag.BoolVar(&config.metadataAllowV1, "metadata-allow-v1", true, "fall back to imdsv1 when the metadata service refuses a session token")
+	flag.IntVar(&config.awsMaxRetries, "aws-max-retries", 8, "the number of times an aws api call is retried, backing off with jitter when throttled")
+	flag.StringVar(&config.provider, "provider", "aws", "the provider used to discover the etcd peers, either aws or static")
+	flag.StringVar(&config.staticName, "static-name", "", "the name of this node when using the static provider")
+	flag.DurationVar(&config.syncInterval, "sync-interval", time.Duration(60)*time.Second, "the interval between reconciliations when running in daemon mode")
+	flag.DurationVar(&config.syncJitter, "sync-jitter", time.Duration(10)*time.Second, "the maximum random jitter added to the sync interval in daemon mode")
+	flag.StringVar(&config.stateDir, "state-dir", "", "a directory used to persist state, i.e. the learner and unstarted member times, between runs")
+	flag.IntVar(&config.minClusterSize, "min-cluster-size", 2, "the minimum number of members the cluster can be shrunk to by removals")
+	flag.IntVar(&config.maxRemovals, "max-removals", 1, "the maximum number of members which can be removed in a single run")
+	flag.IntVar(&config.maxWindowRemovals, "max-window-removals", 2, "the maximum number of members which can be removed within the removal window")
+	flag.DurationVar(&config.removalWindow, "removal-window", time.Duration(1)*time.Hour, "the window of time the max-window-removals limit applies to")
+	flag.Var(newListValue(&config.deadStates, []string{"terminated", "shutting-down"}), "dead-states", "a comma separated list of instance states which are considered dead")
+	flag.BoolVar(&config.removeMissing, "remove-missing", true, "remove members whose instances no longer exist")
+	flag.BoolVar(&config.removeDetached, "remove-detached", false, "remove members whose instances are running but no longer in the group")
+	flag.BoolVar(&config.joinAsLearner, "join-as-learner", false, "add new members as non-voting learners, promoting them once they have caught up")
+	flag.DurationVar(&config.learnerTimeout, "learner-timeout", time.Duration(10)*time.Minute, "the time a learner has to catch up before it is removed from the cluster")
+	flag.BoolVar(&config.bootstrapWait, "bootstrap-wait", false, "wait for the group to reach its desired capacity, with every instance running, before bootstrapping a new cluster")
+	flag.DurationVar(&config.bootstrapTimeout, "bootstrap-timeout", time.Duration(10)*time.Minute, "the time to wait for the group to be ready to bootstrap")
+	flag.DurationVar(&config.bootstrapInterval, "bootstrap-interval", time.Duration(10)*time.Second, "the interval between checks of the group when waiting to bootstrap")
+	flag.StringVar(&config.bootstrapLock, "bootstrap-lock", "", "an external lock used to serialize the nodes while no cluster is available, either empty or dynamodb")
+	flag.StringVar(&config.bootstrapLockTable, "bootstrap-lock-table", "etcd-discovery", "the dynamodb table, keyed by the LockID string attribute, holding the bootstrap lock")
+	flag.StringVar(&config.bootstrapLockRegion, "bootstrap-lock-region", "", "the region of the dynamodb table, defaults to the AWS_REGION environment variable")
+	flag.StringVar(&config.bootstrapLockEndpoint, "bootstrap-lock-endpoint", "", "override the dynamodb endpoint, i.e. http://127.0.0.1:8000 for a local stand-in")
+	flag.DurationVar(&config.unstartedGracePeriod, "unstarted-grace-period", time.Duration(10)*time.Minute, "the time a member which never started is kept once no live instance owns its peer url")
+	flag.DurationVar(&config.clusterStateTimeout, "cluster-state-timeout", time.Duration(5)*time.Minute, "the time to retry when the initial cluster state is ambiguous, before failing")
+	flag.DurationVar(&config.clusterStateInterval, "cluster-state-interval", time.Duration(10)*time.Second, "the interval between the attempts to decide the initial cluster state")
+	flag.BoolVar(&config.refuseSplitBrain, "refuse-split-brain", false, "refuse to join the cluster, before writing any outputs, when the group is running more than one cluster")
+	flag.StringVar(&config.dataDir, "data-dir", "", "the etcd data directory, checked for data belonging to a member no longer in the cluster")
+	flag.StringVar(&config.staleDataDir, "stale-data-dir", "refuse", "the action taken when the data directory is stale, either refuse or archive")
+	flag.BoolVar(&config.lock, "lock", true, "serialize the membership changes across the nodes with a lock held in etcd")
+	flag.StringVar(&config.lockKey, "lock-key", "/etcd-discovery/lock", "the key of the membership lock in etcd")
+	flag.StringVar(&config.removalsKey, "removals-key", "/etcd-discovery/removals", "the key in etcd holding the history of member removals for the removal window")
+	flag.DurationVar(&config.lockTTL, "lock-ttl", time.Duration(60)*time.Second, "the time a lock is held should the node holding it die")
+	flag.DurationVar(&config.lockTimeout, "lock-timeout", time.Duration(2)*time.Minute, "the time to wait to acquire a lock")
+	flag.StringVar(&config.staticPeers, "static-peers", "", "a comma separated list of name=address peers when using the static provider")
+	flag.StringVar(&config.staticGroup, "static-group", defaultStaticGroup, "the name of the group when using the static provider, used for the cluster token and the bootstrap lock")
 }
 
 // getConfig grab the command line options, validate the configuration and returns
 func getConfig() error {
 	flag.Parse()
 
-	if config.environmentFile == "" {
-		return fmt.Errorf("you have not set the environment file path to write to")
+	// step: the command is the first argument, any options after it are parsed as well
+	config.command = "run"
+	if flag.NArg() > 0 {
+		config.command = flag.Arg(0)
+		if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+			return err
+		}
+		if flag.NArg() > 0 {
+			return fmt.Errorf("unexpected arguments: %s", strings.Join(flag.Args(), " "))
+		}
+	}
+	if !isCommand(config.command) {
+		return fmt.Errorf("unknown command: %s", config.command)
+	}
+	if (config.command == "plan" || config.command == "apply") && config.proxyMode {
+		return fmt.Errorf("the %s command cannot be used in proxy mode", config.command)
+	}
+
+	// step: parse the outputs, the environment file being an env output
+	config.outputs = nil
+	if config.environmentFile != "" {
+		config.outputs = append(config.outputs, &outputSpec{format: "env", path: config.environmentFile})
+	}
+	for _, x := range config.outputList {
+		spec, err := parseOutputSpec(x)
+		if err != nil {
+			return err
+		}
+		config.outputs = append(config.outputs, spec)
+	}
+	if (config.command == "run" || config.command == "daemon") && len(config.outputs) <= 0 {
+		return fmt.Errorf("you have not set the environment file path or any outputs to write to")
+	}
+	mode, err := strconv.ParseUint(config.outputModeValue, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("the output mode %s is invalid", config.outputModeValue)
+	}
+	config.outputMode = os.FileMode(mode)
+	if config.outputUID, config.outputGID, err = parseOwner(config.outputOwner); err != nil {
+		return fmt.Errorf("the output owner %s is invalid, error: %s", config.outputOwner, err)
+	}
+	if config.unchangedExitCode < 0 || config.unchangedExitCode > 125 {
+		return fmt.Errorf("the unchanged exit code must be between 0 and 125")
 	}
 	if !isPort(config.etcdPeerPort) {
 		return fmt.Errorf("etcd peer port %d is an invalid port", config.etcdPeerPort)
@@ -70,7 +306,10 @@ func getConfig() error {
 	if !isPort(config.etcdClientPort) {
 		return fmt.Errorf("etcd client port %d is an invalid port", config.etcdClientPort)
 	}
-	if config.proxyMode && config.groupName == "" {
+	if config.provider != "aws" && config.provider != "static" {
+		return fmt.Errorf("the provider %s is invalid, must be aws or static", config.provider)
+	}
+	if config.provider == "aws" && config.proxyMode && config.groupName == "" {
 		return fmt.Errorf("you must set the autoscaling group name when in proxy mode")
 	}
 	if config.privateIPs && config.privateHostnames {
@@ -82,6 +321,71 @@ func getConfig() error {
 	if !isSchema(config.etcdPeerScheme) {
 		return fmt.Errorf("the scheme %s for etcd peer is invalid", config.etcdPeerScheme)
 	}
+	if (config.etcdCertFile == "") != (config.etcdKeyFile == "") {
+		return fmt.Errorf("you must set both the etcd client certificate and key")
+	}
+	if config.etcdClientScheme != "https" && (config.etcdCAFile != "" || config.etcdCertFile != "") {
+		return fmt.Errorf("the etcd tls options require the https client scheme")
+	}
+	if config.tlsDir != "" {
+		if config.tlsSignerURL == "" && (config.tlsCACert == "" || config.tlsCAKey == "") {
+			return fmt.Errorf("you must set the certificate authority or signer url when issuing certificates")
+		}
+		if config.tlsSignerURL != "" && config.tlsCACert != "" {
+			return fmt.Errorf("you cannot use both a certificate authority and a signer url")
+		}
+		if config.tlsValidity <= config.tlsRenewBefore {
+			return fmt.Errorf("the certificate validity must be greater than the renewal period")
+		}
+	}
+	if config.bootstrapTimeout <= 0 || config.bootstrapInterval <= 0 {
+		return fmt.Errorf("the bootstrap timeout and interval must be greater than zero")
+	}
+	if config.bootstrapLock != "" && config.bootstrapLock != "dynamodb" {
+		return fmt.Errorf("the bootstrap lock %s is invalid, must be empty or dynamodb", config.bootstrapLock)
+	}
+	if config.bootstrapLock != "" && config.bootstrapLockTable == "" {
+		return fmt.Errorf("you must set the bootstrap lock table")
+	}
+	if config.lockTTL < time.Second || config.lockTimeout <= 0 {
+		return fmt.Errorf("the lock ttl must be at least a second and the lock timeout greater than zero")
+	}
+	if !strings.HasPrefix(config.metadataURL, "http://") && !strings.HasPrefix(config.metadataURL, "https://") {
+		return fmt.Errorf("the metadata url %s is invalid", config.metadataURL)
+	}
+	if config.metadataTimeout < 0 {
+		return fmt.Errorf("the metadata timeout cannot be negative")
+	}
+	if config.awsMaxRetries < 0 {
+		return fmt.Errorf("the aws max retries cannot be negative")
+	}
+	if config.syncInterval <= 0 {
+		return fmt.Errorf("the sync interval must be greater than zero")
+	}
+	if config.syncJitter < 0 {
+		return fmt.Errorf("the sync jitter cannot be negative")
+	}
+	if config.minClusterSize < 1 {
+		return fmt.Errorf("the minimum cluster size must be at least one")
+	}
+	if config.maxRemovals < 0 || config.maxWindowRemovals < 0 {
+		return fmt.Errorf("the removal limits cannot be negative")
+	}
+	if config.learnerTimeout <= 0 {
+		return fmt.Errorf("the learner timeout must be greater than zero")
+	}
+	if config.clusterStateTimeout < 0 || config.clusterStateInterval <= 0 {
+		return fmt.Errorf("the cluster state timeout cannot be negative and the interval must be greater than zero")
+	}
+	if config.staleDataDir != "refuse" && config.staleDataDir != "archive" {
+		return fmt.Errorf("the stale data dir action %s is invalid, must be refuse or archive", config.staleDataDir)
+	}
+	if config.unstartedGracePeriod <= 0 {
+		return fmt.Errorf("the unstarted grace period must be greater than zero")
+	}
+	if config.removalWindow <= 0 {
+		return fmt.Errorf("the removal window must be greater than zero")
+	}
 
 	return nil
 }
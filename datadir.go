@@ -0,0 +1,161 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"go.etcd.io/etcd/server/v3/datadir"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// localMember is the identity of the member held in the local etcd data directory
+type localMember struct {
+	// ID is the member id the data belongs to
+	ID string
+	// ClusterID is the id of the cluster the member belonged to
+	ClusterID string
+}
+
+// checkDataDir compares the member in the local data directory with the cluster, archiving the data
+// if it is stale and configured to do so, otherwise refusing. It returns true if usable data remains
+func checkDataDir(dir string, peers []*peer, available bool) (bool, error) {
+	local, err := readLocalMember(dir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the data directory: %s, error: %s", dir, err)
+	}
+	if local == nil {
+		glog.Infof("no existing data found in the data directory: %s", dir)
+		return false, nil
+	}
+	glog.Infof("found data in directory: %s, member: %s, cluster: %s", dir, local.ID, local.ClusterID)
+
+	// step: without a cluster to compare against, we assume the data is still valid
+	if !available {
+		return true, nil
+	}
+	client, err := newEtcdClient(getEtcdEndpoints(peers))
+	if err != nil {
+		return false, err
+	}
+	defer client.close()
+
+	clusterID, members, err := client.clusterMembers()
+	if err != nil {
+		return false, err
+	}
+	reason := staleReason(local, clusterID, members)
+	if reason == "" {
+		return true, nil
+	}
+	glog.Warningf("the data directory: %s is stale, %s", dir, reason)
+
+	// step: never pull the data from under a running etcd
+	if inUse, err := isDataDirInUse(dir); err != nil {
+		return false, err
+	} else if inUse {
+		return false, fmt.Errorf("the data directory: %s is stale, %s, but is still in use by etcd", dir, reason)
+	}
+	if config.staleDataDir != "archive" {
+		return false, fmt.Errorf("the data directory: %s is stale, %s; remove it or use -stale-data-dir=archive", dir, reason)
+	}
+
+	archive := fmt.Sprintf("%s.stale-%s", datadir.ToMemberDir(dir), time.Now().Format("20060102150405"))
+	glog.Infof("archiving the stale member data to: %s", archive)
+	if err := os.Rename(datadir.ToMemberDir(dir), archive); err != nil {
+		return false, fmt.Errorf("failed to archive the stale data, error: %s", err)
+	}
+
+	return false, nil
+}
+
+// staleReason checks if the local member still belongs to the cluster, returning the reason if not
+func staleReason(local *localMember, clusterID string, members []*member) string {
+	if local.ClusterID != clusterID {
+		return fmt.Sprintf("it belongs to the cluster %s, not %s", local.ClusterID, clusterID)
+	}
+	if findMemberByID(local.ID, members) == nil {
+		return fmt.Sprintf("the member %s has been removed from the cluster", local.ID)
+	}
+
+	return ""
+}
+
+// readLocalMember reads the member and cluster ids from the wal in the data directory, returning
+// nil if the directory holds no data
+func readLocalMember(dir string) (*localMember, error) {
+	walDir := datadir.ToWalDir(dir)
+	if !wal.Exist(walDir) {
+		return nil, nil
+	}
+	logger := zap.NewNop()
+
+	// step: open the wal from the latest snapshot, as the earlier files may have been purged
+	snapshots, err := wal.ValidSnapshotEntries(logger, walDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := walpb.Snapshot{}
+	if len(snapshots) > 0 {
+		snapshot = snapshots[len(snapshots)-1]
+	}
+	w, err := wal.OpenForRead(logger, walDir, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	content, _, _, err := w.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	metadata := &etcdserverpb.Metadata{}
+	if err := metadata.Unmarshal(content); err != nil {
+		return nil, err
+	}
+
+	return &localMember{
+		ID:        formatMemberID(metadata.NodeID),
+		ClusterID: formatMemberID(metadata.ClusterID),
+	}, nil
+}
+
+// isDataDirInUse checks if etcd is holding the lock on the latest wal file
+func isDataDirInUse(dir string) (bool, error) {
+	names, err := filepath.Glob(filepath.Join(datadir.ToWalDir(dir), "*.wal"))
+	if err != nil || len(names) <= 0 {
+		return false, err
+	}
+	sort.Strings(names)
+
+	lock, err := fileutil.TryLockFile(names[len(names)-1], os.O_WRONLY, fileutil.PrivateFileMode)
+	if err == fileutil.ErrLocked {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return false, lock.Close()
+}
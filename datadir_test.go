@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/server/v3/datadir"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.uber.org/zap"
+)
+
+func TestReadLocalMember(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadir")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if local, err := readLocalMember(dir); err != nil || local != nil {
+		t.Fatalf("expected no member in an empty directory, got: %v, error: %v", local, err)
+	}
+
+	// step: create a wal as etcd would on first start
+	metadata, _ := (&etcdserverpb.Metadata{NodeID: 0x1a, ClusterID: 0x2b}).Marshal()
+	if err := os.MkdirAll(datadir.ToMemberDir(dir), 0700); err != nil {
+		t.Fatalf("failed to create the member directory, error: %s", err)
+	}
+	w, err := wal.Create(zap.NewNop(), datadir.ToWalDir(dir), metadata)
+	if err != nil {
+		t.Fatalf("failed to create the wal, error: %s", err)
+	}
+	if inUse, err := isDataDirInUse(dir); err != nil || !inUse {
+		t.Errorf("expected the data directory to be in use while the wal is open, error: %v", err)
+	}
+	w.Close()
+	if inUse, err := isDataDirInUse(dir); err != nil || inUse {
+		t.Errorf("expected the data directory to be free once the wal is closed, error: %v", err)
+	}
+
+	local, err := readLocalMember(dir)
+	if err != nil {
+		t.Fatalf("unexpected error reading the member: %s", err)
+	}
+	if local == nil || local.ID != formatMemberID(0x1a) || local.ClusterID != formatMemberID(0x2b) {
+		t.Errorf("unexpected local member: %v", local)
+	}
+	if _, err := os.Stat(datadir.ToWalDir(dir)); err != nil {
+		t.Errorf("the wal should be left in place, error: %s", err)
+	}
+}
+
+func TestStaleReason(t *testing.T) {
+	local := &localMember{ID: "1a", ClusterID: "2b"}
+	cases := []struct {
+		name      string
+		clusterID string
+		members   []*member
+		stale     bool
+	}{
+		{name: "still a member", clusterID: "2b", members: []*member{{ID: "1a"}, {ID: "1b"}}},
+		{name: "removed from the cluster", clusterID: "2b", members: []*member{{ID: "1b"}}, stale: true},
+		{name: "another cluster", clusterID: "3c", members: []*member{{ID: "1a"}}, stale: true},
+	}
+	for _, c := range cases {
+		if reason := staleReason(local, c.clusterID, c.members); (reason != "") != c.stale {
+			t.Errorf("case %s, expected stale: %t, got reason: %q", c.name, c.stale, reason)
+		}
+	}
+}
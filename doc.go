@@ -16,8 +16,9 @@ limitations under the License.
 package main
 
 import (
-	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
 const (
@@ -27,12 +28,99 @@ const (
 	version = "v0.0.1"
 )
 
+// peer is a cloud neutral representation of a node in the etcd group
+type peer struct {
+	// Name is the unique name of the peer, used as the etcd member name
+	Name string `json:"name"`
+	// PrivateIP is the private ip address of the peer
+	PrivateIP string `json:"privateIp"`
+	// PrivateDNSName is the private dns name of the peer
+	PrivateDNSName string `json:"privateDnsName"`
+	// Zone is the availability zone or failure domain of the peer
+	Zone string `json:"zone"`
+	// Healthy indicates the peer is running and passing health checks
+	Healthy bool `json:"healthy"`
+	// State is the lifecycle state of the peer, i.e. running, stopped or terminated
+	State string `json:"state"`
+}
+
+// provider is the source of peers for the etcd cluster, i.e. an aws auto-scaling group
+type provider interface {
+	// self retrieves the peer for the node we are running on
+	self() (*peer, error)
+	// group retrieves the name of the group hosting the etcd peers
+	group() (string, error)
+	// peers retrieves all the peers in the group, healthy or not
+	peers() ([]*peer, error)
+	// desiredCapacity retrieves the number of peers the group should have
+	desiredCapacity() (int, error)
+	// describe retrieves the named peers, whether in the group or not; any which no
+	// longer exist are absent from the result
+	describe(names []string) (map[string]*peer, error)
+}
+
+// locker is a lock used to serialize changes to the cluster across the nodes
+type locker interface {
+	// lock acquires the lock, waiting up to the lock timeout
+	lock() error
+	// unlock releases the lock
+	unlock() error
+	// held checks the lock has not been lost since it was acquired
+	held() error
+}
+
+// metadataService is the source of the identity and tags of the running instance
+type metadataService interface {
+	// getInstanceIdentity retrieves the identity document and hostname of the instance
+	getInstanceIdentity() (*awsIdentity, error)
+	// getInstanceTag retrieves the value of the instance tag, empty if not available
+	getInstanceTag(key string) (string, error)
+}
+
+// member is a member of the etcd cluster
+type member struct {
+	// ID is the etcd member id
+	ID string
+	// Name is the name of the member, empty if the member has not started yet
+	Name string
+	// PeerURLs is the list of peer urls advertised by the member
+	PeerURLs []string
+	// ClientURLs is the list of client urls advertised by the member
+	ClientURLs []string
+	// IsLearner indicates the member is a non-voting raft learner
+	IsLearner bool
+}
+
 // awsClient is the wrapper for aws api access
 type awsClient struct {
 	// the client for auto-scaling
-	asg *autoscaling.AutoScaling
+	asg autoscalingiface.AutoScalingAPI
 	// the instance client
-	compute *ec2.EC2
+	compute ec2iface.EC2API
+	// the instances described during this run, keyed by instance id
+	instances map[string]*ec2.Instance
+}
+
+// awsProvider is the provider backed by an aws auto-scaling group
+type awsProvider struct {
+	// the aws client
+	client *awsClient
+	// the client for the instance metadata service
+	metadata metadataService
+	// the identity of the running instance
+	identity *awsIdentity
+	// the name of the auto-scaling group
+	groupName string
+}
+
+// staticProvider is the provider backed by a fixed list of peers
+type staticProvider struct {
+	// the name of the running node
+	name string
+	// the name of the group
+	groupName string
+	// the list of peers
+	list []*peer
 }
 
 // awsIdentity is the instance document for the running instance
@@ -0,0 +1,244 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeGroup creates a fake with the group tagged on the instances and the instances launched
+func newFakeGroup(ids ...string) *fakeAWS {
+	fake := newFakeAWS()
+	fake.tagged = true
+	fake.addGroup("etcd", len(ids))
+	for i, id := range ids {
+		fake.launch("etcd", id, fmt.Sprintf("127.0.0.%d", 11+i))
+	}
+
+	return fake
+}
+
+// useFakeNode points the discovery at the fake, running as the instance, with the environment
+// written to a temporary file; it returns the file and a function restoring the globals
+func useFakeNode(t *testing.T, fake *fakeAWS, id string) (string, func()) {
+	savedConfig, savedDiscovery, savedStore := *config, discovery, store
+	restore := func() {
+		*config, discovery, store = savedConfig, savedDiscovery, savedStore
+	}
+
+	// step: grab a port nothing is listening on, so the peers are probed as down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	filename := filepath.Join(t.TempDir(), "etcd.env")
+	config.groupName = ""
+	config.privateIPs = true
+	config.etcdClientPort = port
+	config.outputs = []*outputSpec{{format: "env", path: filename}}
+	config.bootstrapWait = false
+	config.bootstrapLock = ""
+	config.dataDir = ""
+	config.tlsDir = ""
+	config.clusterStateTimeout = time.Second
+	store, _ = loadState("")
+
+	provider, err := newFakeProvider(fake, id, nil)
+	if err != nil {
+		restore()
+		t.Fatalf("unexpected error: %s", err)
+	}
+	discovery = provider
+
+	return filename, restore
+}
+
+func TestEndToEndBootstrap(t *testing.T) {
+	fake := newFakeGroup("i-3", "i-1", "i-2")
+
+	var cluster string
+	for _, id := range []string{"i-1", "i-2", "i-3"} {
+		filename, restore := useFakeNode(t, fake, id)
+		changed, err := runDiscovery()
+		if err != nil {
+			restore()
+			t.Fatalf("node %s, unexpected error: %s", id, err)
+		}
+		content, _ := ioutil.ReadFile(filename)
+		expected := fmt.Sprintf("ETCD_INITIAL_CLUSTER=\"i-1=%s,i-2=%s,i-3=%s\"",
+			getPeerURL("127.0.0.12"), getPeerURL("127.0.0.13"), getPeerURL("127.0.0.11"))
+		restore()
+
+		if !changed {
+			t.Errorf("node %s, expected the environment file to be written", id)
+		}
+		if !strings.Contains(string(content), "ETCD_INITIAL_CLUSTER_STATE=\"new\"") {
+			t.Errorf("node %s, expected a new cluster, got: %s", id, content)
+		}
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("node %s, expected the initial cluster: %s, got: %s", id, expected, content)
+		}
+		if cluster == "" {
+			cluster = string(content)
+		} else if !strings.Contains(cluster, expected) {
+			t.Errorf("node %s, expected every node to generate the same initial cluster", id)
+		}
+	}
+}
+
+func TestEndToEndMembership(t *testing.T) {
+	cases := []struct {
+		name     string
+		node     string
+		script   func(*fakeAWS)
+		expected []string
+	}{
+		{
+			name: "steady",
+			node: "i-1",
+		},
+		{
+			name: "scale out",
+			node: "i-4",
+			script: func(fake *fakeAWS) {
+				fake.addGroup("etcd", 4)
+				fake.launch("etcd", "i-4", "127.0.0.14")
+			},
+			expected: []string{"add:i-4"},
+		},
+		{
+			name:     "termination",
+			node:     "i-1",
+			script:   func(fake *fakeAWS) { fake.terminate("i-3") },
+			expected: []string{"remove:i-3"},
+		},
+		{
+			name:     "terminated and aged out",
+			node:     "i-1",
+			script:   func(fake *fakeAWS) { fake.forget("i-3") },
+			expected: []string{"remove:i-3"},
+		},
+		{
+			name: "replaced",
+			node: "i-4",
+			script: func(fake *fakeAWS) {
+				fake.terminate("i-3")
+				fake.launch("etcd", "i-4", "127.0.0.14")
+			},
+			expected: []string{"remove:i-3", "add:i-4"},
+		},
+		{
+			name:   "stopped",
+			node:   "i-1",
+			script: func(fake *fakeAWS) { fake.stop("i-2") },
+		},
+		{
+			name: "stopped and started",
+			node: "i-1",
+			script: func(fake *fakeAWS) {
+				fake.stop("i-2")
+				fake.start("i-2", "127.0.0.22")
+			},
+			expected: []string{"update:i-2"},
+		},
+	}
+	for _, c := range cases {
+		fake := newFakeGroup("i-1", "i-2", "i-3")
+		_, restore := useFakeNode(t, fake, "i-1")
+		var members []*member
+		for i, x := range fake.sortedInstances() {
+			members = append(members, &member{ID: fmt.Sprintf("%d", i+1), Name: x.id, PeerURLs: []string{getPeerURL(x.ip)}})
+		}
+		if c.script != nil {
+			c.script(fake)
+		}
+		restore()
+
+		_, restore = useFakeNode(t, fake, c.node)
+		self, group, err := discoverPeers()
+		if err != nil {
+			restore()
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		view := newClusterView(self, healthyPeers(group), members)
+		if err := classifyMembers(view, group); err != nil {
+			restore()
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		plan := planMembership(view)
+		restore()
+
+		var list []string
+		for _, x := range plan {
+			list = append(list, x.Kind+":"+x.Name)
+		}
+		if strings.Join(list, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("case %s, expected the plan: %v, got: %v", c.name, c.expected, list)
+		}
+	}
+}
+
+func TestEndToEndMissingGroup(t *testing.T) {
+	cases := []struct {
+		name   string
+		group  string
+		script func(*fakeAWS)
+	}{
+		{
+			name:  "unknown group",
+			group: "missing",
+		},
+		{
+			name:   "detached instance",
+			script: func(fake *fakeAWS) { fake.launch("", "i-1", "127.0.0.11") },
+		},
+		{
+			name:   "deleted group",
+			script: func(fake *fakeAWS) { delete(fake.groups, "etcd") },
+		},
+	}
+	for _, c := range cases {
+		fake := newFakeGroup("i-1", "i-2", "i-3")
+		if c.script != nil {
+			c.script(fake)
+		}
+		filename, restore := useFakeNode(t, fake, "i-1")
+		config.groupName = c.group
+		discovery.(*awsProvider).groupName = c.group
+
+		_, err := runDiscovery()
+		_, missing := ioutil.ReadFile(filename)
+		restore()
+
+		if err == nil {
+			t.Errorf("case %s, expected an error", c.name)
+		}
+		if missing == nil {
+			t.Errorf("case %s, the environment file should not have been written", c.name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// envVar is a environment variable passed to etcd
+type envVar struct {
+	// Name is the name of the variable
+	Name string `json:"name"`
+	// Value is the value of the variable
+	Value string `json:"value"`
+}
+
+// getEnvironment generates the etcd environment for the node; any of the urls or the cluster token
+// set on the command line override the generated values
+func getEnvironment(self *peer, members []*peer, state, group string, proxy bool) []*envVar {
+	mode := "off"
+	if proxy {
+		mode = "on"
+	}
+	// step: etcd can only listen on ip addresses, the static peers may be hostnames; the wildcard
+	// already covers the loopback, and binding both on the same port fails
+	listenAddress := "0.0.0.0"
+	listenClientURLs := getClientURL(listenAddress)
+	if net.ParseIP(self.PrivateIP) != nil {
+		listenAddress = self.PrivateIP
+		listenClientURLs = strings.Join(uniqueList(getClientURL(listenAddress), getClientURL("127.0.0.1")), ",")
+	}
+
+	environment := []*envVar{
+		{Name: "ETCD_INITIAL_CLUSTER_STATE", Value: state},
+		{Name: "ETCD_NAME", Value: self.Name},
+		{Name: "ETCD_INITIAL_CLUSTER", Value: getPeerURLs(members)},
+		{Name: "ETCD_PROXY", Value: mode},
+		{Name: "ETCD_LISTEN_CLIENT_URLS", Value: defaultValue(config.listenClientURLs, listenClientURLs)},
+		{Name: "ETCD_ADVERTISE_CLIENT_URLS", Value: defaultValue(config.advertiseClientURLs, getClientURL(self.address()))},
+	}
+	// step: the peer settings are only used by members of the cluster
+	if !proxy {
+		environment = append(environment, []*envVar{
+			{Name: "ETCD_LISTEN_PEER_URLS", Value: defaultValue(config.listenPeerURLs, getPeerURL(listenAddress))},
+			{Name: "ETCD_INITIAL_ADVERTISE_PEER_URLS", Value: defaultValue(config.initialAdvertisePeerURLs, getPeerURL(self.address()))},
+			{Name: "ETCD_INITIAL_CLUSTER_TOKEN", Value: defaultValue(config.initialClusterToken, getClusterToken(group))},
+		}...)
+	}
+
+	return environment
+}
+
+// getClusterToken derives a deterministic cluster token from the group name, so every node in
+// the group generates the same token
+func getClusterToken(group string) string {
+	return fmt.Sprintf("etcd-%x", sha256.Sum256([]byte(group)))[:21]
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func getEnvVar(environment []*envVar, name string) string {
+	for _, x := range environment {
+		if x.Name == name {
+			return x.Value
+		}
+	}
+
+	return ""
+}
+
+func TestGetEnvironment(t *testing.T) {
+	self := &peer{Name: "i-self", PrivateIP: "10.0.1.10", PrivateDNSName: "ip-10-0-1-10.internal"}
+	other := &peer{Name: "i-other", PrivateIP: "10.0.1.11", PrivateDNSName: "ip-10-0-1-11.internal"}
+	environment := getEnvironment(self, []*peer{self, other}, "new", "etcd-group", false)
+
+	expected := map[string]string{
+		"ETCD_INITIAL_CLUSTER_STATE":       "new",
+		"ETCD_NAME":                        "i-self",
+		"ETCD_INITIAL_CLUSTER":             "i-other=https://ip-10-0-1-11.internal:2380,i-self=https://ip-10-0-1-10.internal:2380",
+		"ETCD_PROXY":                       "off",
+		"ETCD_LISTEN_PEER_URLS":            "https://10.0.1.10:2380",
+		"ETCD_LISTEN_CLIENT_URLS":          "https://10.0.1.10:2379,https://127.0.0.1:2379",
+		"ETCD_ADVERTISE_CLIENT_URLS":       "https://ip-10-0-1-10.internal:2379",
+		"ETCD_INITIAL_ADVERTISE_PEER_URLS": "https://ip-10-0-1-10.internal:2380",
+		"ETCD_INITIAL_CLUSTER_TOKEN":       getClusterToken("etcd-group"),
+	}
+	for name, value := range expected {
+		if got := getEnvVar(environment, name); got != value {
+			t.Errorf("variable %s expected %q, got %q", name, value, got)
+		}
+	}
+	if getClusterToken("etcd-group") == getClusterToken("another-group") {
+		t.Errorf("the cluster token should differ between groups")
+	}
+
+	// step: check the overrides
+	config.initialClusterToken = "my-token"
+	defer func() { config.initialClusterToken = "" }()
+	environment = getEnvironment(self, []*peer{self, other}, "new", "etcd-group", false)
+	if got := getEnvVar(environment, "ETCD_INITIAL_CLUSTER_TOKEN"); got != "my-token" {
+		t.Errorf("expected the cluster token override, got %q", got)
+	}
+}
+
+func TestGetEnvironmentListenAddress(t *testing.T) {
+	cases := []struct {
+		name     string
+		self     *peer
+		proxy    bool
+		expected string
+		clients  string
+	}{
+		{
+			name:     "ip address",
+			self:     &peer{Name: "a", PrivateIP: "10.0.1.10", PrivateDNSName: "10.0.1.10"},
+			expected: "https://10.0.1.10:2380",
+			clients:  "https://10.0.1.10:2379,https://127.0.0.1:2379",
+		},
+		{
+			name:     "loopback address",
+			self:     &peer{Name: "a", PrivateIP: "127.0.0.1", PrivateDNSName: "localhost"},
+			expected: "https://127.0.0.1:2380",
+			clients:  "https://127.0.0.1:2379",
+		},
+		{
+			name:     "static peer hostname",
+			self:     &peer{Name: "a", PrivateIP: "etcd-a.example.com", PrivateDNSName: "etcd-a.example.com"},
+			expected: "https://0.0.0.0:2380",
+			clients:  "https://0.0.0.0:2379",
+		},
+		{
+			name:     "no address",
+			self:     &peer{Name: "a", PrivateDNSName: "etcd-a.example.com"},
+			expected: "https://0.0.0.0:2380",
+			clients:  "https://0.0.0.0:2379",
+		},
+		{
+			name:    "proxy without an address",
+			self:    &peer{Name: "a", PrivateDNSName: "etcd-a.example.com"},
+			proxy:   true,
+			clients: "https://0.0.0.0:2379",
+		},
+	}
+	for _, c := range cases {
+		environment := getEnvironment(c.self, []*peer{c.self}, "new", "etcd-group", c.proxy)
+		if got := getEnvVar(environment, "ETCD_LISTEN_PEER_URLS"); got != c.expected {
+			t.Errorf("case %s, expected the listen peer urls %q, got %q", c.name, c.expected, got)
+		}
+		if got := getEnvVar(environment, "ETCD_LISTEN_CLIENT_URLS"); got != c.clients {
+			t.Errorf("case %s, expected the listen client urls %q, got %q", c.name, c.clients, got)
+		}
+		if got := getEnvVar(environment, "ETCD_ADVERTISE_CLIENT_URLS"); !strings.Contains(got, c.self.address()) {
+			t.Errorf("case %s, expected the advertised client url to use the address, got %q", c.name, got)
+		}
+	}
+}
@@ -16,55 +16,166 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	etcd "github.com/coreos/etcd/client"
 	"github.com/golang/glog"
-	"golang.org/x/net/context"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// dialTimeout is the time permitted to connect to the cluster
+	dialTimeout = time.Duration(5) * time.Second
+	// requestTimeout is the time permitted for a request to the cluster
+	requestTimeout = time.Duration(10) * time.Second
 )
 
 type etcdClient struct {
-	// the etcd client
-	c etcd.Client
-	// the members client
-	client etcd.MembersAPI
+	// the etcd v3 client
+	client *clientv3.Client
 }
 
 // newEtcdClient create a new etcd client wrapper
 func newEtcdClient(endpoints []string) (*etcdClient, error) {
 	glog.V(3).Infof("creating a new etcd client, endpoints: %s", strings.Join(endpoints, ","))
+	// step: create the tls configuration if required
+	tlsConfig, err := getEtcdTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// step: create a client for etcd
-	c, err := etcd.New(etcd.Config{Endpoints: endpoints})
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+		TLS:         tlsConfig,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &etcdClient{
-		c:      c,
-		client: etcd.NewMembersAPI(c),
-	}, nil
+	return &etcdClient{client: c}, nil
+}
+
+// getEtcdTLSConfig creates the tls configuration for the etcd client, returning nil when the
+// client scheme is not https
+func getEtcdTLSConfig() (*tls.Config, error) {
+	if config.etcdClientScheme != "https" {
+		return nil, nil
+	}
+
+	return newTLSConfig(config.etcdCAFile, config.etcdCertFile, config.etcdKeyFile)
+}
+
+// getPeerTLSConfig creates the tls configuration used to talk to the peer port, preferring the node
+// certificates when we have issued them, returning nil when the peer scheme is not https
+func getPeerTLSConfig() (*tls.Config, error) {
+	if config.etcdPeerScheme != "https" {
+		return nil, nil
+	}
+	caFile, certFile, keyFile := config.etcdCAFile, config.etcdCertFile, config.etcdKeyFile
+	if config.tlsDir != "" {
+		if _, err := os.Stat(filepath.Join(config.tlsDir, "peer.pem")); err == nil {
+			caFile = filepath.Join(config.tlsDir, "ca.pem")
+			certFile = filepath.Join(config.tlsDir, "peer.pem")
+			keyFile = filepath.Join(config.tlsDir, "peer-key.pem")
+		}
+	}
+
+	return newTLSConfig(caFile, certFile, keyFile)
+}
+
+// newTLSConfig creates a tls configuration from the certificate authority and client certificate
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.etcdServerName,
+		InsecureSkipVerify: config.etcdInsecureSkipVerify,
+	}
+
+	// step: load the certificate authority bundle
+	if caFile != "" {
+		content, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the etcd ca file: %s, error: %s", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in the etcd ca file: %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// step: load the client certificate
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the etcd client certificate, error: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// close releases the connections to the cluster
+func (r *etcdClient) close() {
+	if err := r.client.Close(); err != nil {
+		glog.V(4).Infof("failed to close the etcd client, error: %s", err)
+	}
 }
 
 // listMembers retrieves a list of members
-func (r *etcdClient) listMembers() ([]etcd.Member, error) {
-	members, err := r.client.List(context.Background())
+func (r *etcdClient) listMembers() ([]*member, error) {
+	_, list, err := r.clusterMembers()
+
+	return list, err
+}
+
+// clusterMembers retrieves the id of the cluster along with its members
+func (r *etcdClient) clusterMembers() (string, []*member, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := r.client.MemberList(ctx)
 	if err != nil {
-		return nil, r.handleError(err)
+		return "", nil, r.handleError(err)
+	}
+
+	var list []*member
+	for _, m := range resp.Members {
+		list = append(list, newMember(m))
 	}
 
-	return members, nil
+	return formatMemberID(resp.Header.ClusterId), list, nil
 }
 
-// addMember add the member to the cluster
-func (r *etcdClient) addMember(name, url string) error {
-	if found, err := r.hasMember(name); err != nil {
+// addMember add the member to the cluster, optionally as a non-voting learner
+func (r *etcdClient) addMember(name, url string, learner bool) error {
+	if found, err := r.hasMember(name, url); err != nil {
 		return err
 	} else if found {
 		return nil
 	}
 
-	if _, err := r.client.Add(context.Background(), url); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	add := r.client.MemberAdd
+	if learner {
+		add = r.client.MemberAddAsLearner
+	}
+	if _, err := add(ctx, []string{url}); err != nil {
 		return r.handleError(err)
 	}
 
@@ -73,19 +184,153 @@ func (r *etcdClient) addMember(name, url string) error {
 
 // deleteMemeber remove's a member from the cluster
 func (r *etcdClient) deleteMember(id string) error {
+	memberID, err := parseMemberID(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
 	// step: delete the member
-	if err := r.client.Remove(context.Background(), id); err != nil {
+	if _, err := r.client.MemberRemove(ctx, memberID); err != nil {
+		return r.handleError(err)
+	}
+
+	return nil
+}
+
+// updateMember updates the peer url of a member
+func (r *etcdClient) updateMember(id, url string) error {
+	memberID, err := parseMemberID(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if _, err := r.client.MemberUpdate(ctx, memberID, []string{url}); err != nil {
+		return r.handleError(err)
+	}
+
+	return nil
+}
+
+// promoteMember promotes the learner to a voting member, returning false if the learner
+// has not caught up with the leader yet
+func (r *etcdClient) promoteMember(id string) (bool, error) {
+	memberID, err := parseMemberID(id)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if _, err := r.client.MemberPromote(ctx, memberID); err != nil {
+		if err == rpctypes.ErrMemberLearnerNotReady {
+			return false, nil
+		}
+		return false, r.handleError(err)
+	}
+
+	return true, nil
+}
+
+// getRemovals retrieves the history of member removals shared by the nodes
+func (r *etcdClient) getRemovals(key string) ([]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := r.client.Get(ctx, key)
+	if err != nil {
+		return nil, r.handleError(err)
+	}
+	var list []time.Time
+	if len(resp.Kvs) > 0 {
+		if err := json.Unmarshal(resp.Kvs[0].Value, &list); err != nil {
+			return nil, fmt.Errorf("failed to decode the removal history in key: %s, error: %s", key, err)
+		}
+	}
+
+	return list, nil
+}
+
+// recordRemoval adds a removal to the shared history, dropping any which are older than the window;
+// the caller is expected to hold the membership lock
+func (r *etcdClient) recordRemoval(key string, window time.Duration) error {
+	list, err := r.getRemovals(key)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(append(recentRemovals(list, window), time.Now()))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if _, err := r.client.Put(ctx, key, string(content)); err != nil {
 		return r.handleError(err)
 	}
 
 	return nil
 }
 
+// leaderIndex retrieves the raft index of the cluster leader
+func (r *etcdClient) leaderIndex() (uint64, error) {
+	for _, endpoint := range r.client.Endpoints() {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		resp, err := r.client.Status(ctx, endpoint)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if resp.Leader == resp.Header.MemberId {
+			return resp.RaftIndex, nil
+		}
+		// step: ask the leader directly
+		members, err := r.listMembers()
+		if err != nil {
+			return 0, err
+		}
+		leader := findMemberByID(formatMemberID(resp.Leader), members)
+		if leader == nil {
+			return 0, fmt.Errorf("the leader %x is not a member of the cluster", resp.Leader)
+		}
+		return r.memberIndex(leader)
+	}
+
+	return 0, fmt.Errorf("no endpoints answered the status request")
+}
+
+// memberIndex retrieves the raft index of the member
+func (r *etcdClient) memberIndex(m *member) (uint64, error) {
+	var lastErr error
+	for _, u := range m.ClientURLs {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		resp, err := r.client.Status(ctx, u)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp.RaftIndex, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("the member %s has no client urls", m.ID)
+	}
+
+	return 0, lastErr
+}
+
 // getMember retrieves a specific member from the cluster
-func (r *etcdClient) getMember(name string) (etcd.Member, error) {
+func (r *etcdClient) getMember(name string) (*member, error) {
 	members, err := r.listMembers()
 	if err != nil {
-		return etcd.Member{}, err
+		return nil, err
 	}
 
 	for _, m := range members {
@@ -94,17 +339,17 @@ func (r *etcdClient) getMember(name string) (etcd.Member, error) {
 		}
 	}
 
-	return etcd.Member{}, fmt.Errorf("the member does not exist")
+	return nil, fmt.Errorf("the member does not exist")
 }
 
-// hasMember checks if a member exists
-func (r *etcdClient) hasMember(name string) (bool, error) {
+// hasMember checks if a member exists with the name, or with the peer url should it not have started
+func (r *etcdClient) hasMember(name, url string) (bool, error) {
 	members, err := r.listMembers()
 	if err != nil {
 		return false, err
 	}
 	for _, m := range members {
-		if m.Name == name {
+		if m.Name == name || (m.Name == "" && containedIn(url, m.PeerURLs)) {
 			return true, nil
 		}
 	}
@@ -112,16 +357,61 @@ func (r *etcdClient) hasMember(name string) (bool, error) {
 	return false, nil
 }
 
+// isHealthy checks if the member is answering status requests on any of its client urls
+func (r *etcdClient) isHealthy(m *member) bool {
+	for _, u := range m.ClientURLs {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		resp, err := r.client.Status(ctx, u)
+		cancel()
+		if err != nil {
+			glog.V(4).Infof("health check on member: %s, url: %s failed, error: %s", m.Name, u, err)
+			continue
+		}
+		if len(resp.Errors) <= 0 {
+			return true
+		}
+		glog.V(4).Infof("member: %s, url: %s is reporting errors: %s", m.Name, u, strings.Join(resp.Errors, ","))
+	}
+
+	return false
+}
+
 func (r *etcdClient) handleError(err error) error {
 	if err == context.Canceled {
 		glog.Errorf("the operation was canceled")
 	} else if err == context.DeadlineExceeded {
 		glog.Errorf("the operation exceeded deadline")
-	} else if cerr, ok := err.(*etcd.ClusterError); ok {
-		glog.Errorf("cluster error, %s", cerr.Detail())
+	} else if cerr, ok := err.(rpctypes.EtcdError); ok {
+		glog.Errorf("cluster error, %s", cerr.Error())
 	} else {
-		glog.Errorf("bad cluster configuration")
+		glog.Errorf("bad cluster configuration, error: %s", err)
 	}
 
 	return err
 }
+
+// newMember converts the etcd member
+func newMember(m *etcdserverpb.Member) *member {
+	return &member{
+		ID:         formatMemberID(m.ID),
+		Name:       m.Name,
+		PeerURLs:   m.PeerURLs,
+		ClientURLs: m.ClientURLs,
+		IsLearner:  m.IsLearner,
+	}
+}
+
+// formatMemberID converts the member id to its hex representation
+func formatMemberID(id uint64) string {
+	return strconv.FormatUint(id, 16)
+}
+
+// parseMemberID converts the hex representation of the member id
+func parseMemberID(id string) (uint64, error) {
+	memberID, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid member id: %s, error: %s", id, err)
+	}
+
+	return memberID, nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// newTestCertificates issues the node certificates from a test ca into the directory
+func newTestCertificates(t *testing.T, dir string) {
+	newTestCA(t, dir)
+	config.tlsDir = dir
+	self := &peer{Name: "i-self", PrivateIP: "10.0.1.10", PrivateDNSName: "ip-10-0-1-10.internal"}
+	if err := issueCertificates(self); err != nil {
+		t.Fatalf("failed to issue the certificates, error: %s", err)
+	}
+}
+
+// isCertificate checks the tls configuration presents the certificate in the file
+func isCertificate(t *testing.T, tlsConfig *tls.Config, filename string) bool {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read the certificate, error: %s", err)
+	}
+	block, _ := pem.Decode(content)
+
+	return len(tlsConfig.Certificates) == 1 && bytes.Equal(tlsConfig.Certificates[0].Certificate[0], block.Bytes)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	defer func(saved discoveryConfig) { *config = saved }(*config)
+	dir := t.TempDir()
+	newTestCertificates(t, dir)
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("not a certificate\n"), 0600)
+
+	ca := filepath.Join(dir, "ca.pem")
+	cert := filepath.Join(dir, "server.pem")
+	key := filepath.Join(dir, "server-key.pem")
+
+	cases := []struct {
+		name     string
+		ca       string
+		cert     string
+		key      string
+		invalid  bool
+		roots    bool
+		expected string
+	}{
+		{name: "no files"},
+		{name: "missing ca", ca: filepath.Join(dir, "missing.pem"), invalid: true},
+		{name: "no certificates in the ca", ca: empty, invalid: true},
+		{name: "ca only", ca: ca, roots: true},
+		{name: "certificate and key", ca: ca, cert: cert, key: key, roots: true, expected: cert},
+		{name: "missing key", ca: ca, cert: cert, key: filepath.Join(dir, "missing-key.pem"), invalid: true},
+		{name: "mismatched key", ca: ca, cert: cert, key: filepath.Join(dir, "peer-key.pem"), invalid: true},
+	}
+	for _, c := range cases {
+		tlsConfig, err := newTLSConfig(c.ca, c.cert, c.key)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("case %s, expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		if (tlsConfig.RootCAs != nil) != c.roots {
+			t.Errorf("case %s, expected the root cas set: %t", c.name, c.roots)
+		}
+		if c.expected != "" && !isCertificate(t, tlsConfig, c.expected) {
+			t.Errorf("case %s, expected the certificate: %s", c.name, c.expected)
+		}
+		if c.expected == "" && len(tlsConfig.Certificates) != 0 {
+			t.Errorf("case %s, expected no client certificate", c.name)
+		}
+	}
+
+	// step: check the server name and verification are passed through
+	config.etcdServerName = "etcd.internal"
+	config.etcdInsecureSkipVerify = true
+	tlsConfig, err := newTLSConfig("", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tlsConfig.ServerName != "etcd.internal" || !tlsConfig.InsecureSkipVerify {
+		t.Errorf("expected the server name and skip verify passed through, got: %q, %t", tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+	}
+}
+
+func TestGetPeerTLSConfig(t *testing.T) {
+	defer func(saved discoveryConfig) { *config = saved }(*config)
+	dir := t.TempDir()
+	newTestCertificates(t, dir)
+	config.etcdCAFile = filepath.Join(dir, "ca.pem")
+	config.etcdCertFile = filepath.Join(dir, "server.pem")
+	config.etcdKeyFile = filepath.Join(dir, "server-key.pem")
+
+	cases := []struct {
+		name     string
+		scheme   string
+		tlsDir   string
+		expected string
+	}{
+		{name: "plain peers", scheme: "http", tlsDir: dir},
+		{name: "no tls dir", scheme: "https", expected: "server.pem"},
+		{name: "issued certificates", scheme: "https", tlsDir: dir, expected: "peer.pem"},
+		{name: "not yet issued", scheme: "https", tlsDir: t.TempDir(), expected: "server.pem"},
+	}
+	for _, c := range cases {
+		config.etcdPeerScheme = c.scheme
+		config.tlsDir = c.tlsDir
+
+		tlsConfig, err := getPeerTLSConfig()
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		if c.expected == "" {
+			if tlsConfig != nil {
+				t.Errorf("case %s, expected no tls configuration", c.name)
+			}
+			continue
+		}
+		if tlsConfig == nil || !isCertificate(t, tlsConfig, filepath.Join(dir, c.expected)) {
+			t.Errorf("case %s, expected the certificate: %s", c.name, c.expected)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// iamPolicy is an aws iam policy document
+type iamPolicy struct {
+	// Version is the policy language version
+	Version string `json:"Version"`
+	// Statement is the list of permissions
+	Statement []*iamStatement `json:"Statement"`
+}
+
+// iamStatement is a single permission in the policy
+type iamStatement struct {
+	// Sid describes the statement
+	Sid string `json:"Sid"`
+	// Effect is allow or deny
+	Effect string `json:"Effect"`
+	// Action is the list of api calls
+	Action []string `json:"Action"`
+	// Resource is the resource the actions apply to
+	Resource string `json:"Resource"`
+}
+
+// getIAMPolicy generates the least privilege iam policy the configuration requires
+func getIAMPolicy() (string, error) {
+	policy := &iamPolicy{Version: "2012-10-17"}
+
+	if config.provider == "aws" {
+		// step: the describe calls do not support resource level permissions
+		policy.Statement = append(policy.Statement, &iamStatement{
+			Sid:      "DiscoverPeers",
+			Effect:   "Allow",
+			Action:   []string{"autoscaling:DescribeAutoScalingGroups", "ec2:DescribeInstances"},
+			Resource: "*",
+		})
+		// step: unless the group is given, it's found from the tags on our instance
+		if config.groupName == "" {
+			policy.Statement = append(policy.Statement, &iamStatement{
+				Sid:      "FindGroup",
+				Effect:   "Allow",
+				Action:   []string{"ec2:DescribeTags", "autoscaling:DescribeAutoScalingInstances"},
+				Resource: "*",
+			})
+		}
+	}
+	if config.bootstrapLock == "dynamodb" {
+		policy.Statement = append(policy.Statement, &iamStatement{
+			Sid:      "BootstrapLock",
+			Effect:   "Allow",
+			Action:   []string{"dynamodb:PutItem", "dynamodb:UpdateItem", "dynamodb:DeleteItem"},
+			Resource: fmt.Sprintf("arn:aws:dynamodb:%s:*:table/%s", defaultValue(config.bootstrapLockRegion, "*"), config.bootstrapLockTable),
+		})
+	}
+	if len(policy.Statement) <= 0 {
+		return "", fmt.Errorf("the configuration does not make any aws api calls, no policy is required")
+	}
+
+	content, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
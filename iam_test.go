@@ -0,0 +1,82 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetIAMPolicy(t *testing.T) {
+	defer func(provider, group, lock string) {
+		config.provider, config.groupName, config.bootstrapLock = provider, group, lock
+	}(config.provider, config.groupName, config.bootstrapLock)
+
+	cases := []struct {
+		name     string
+		provider string
+		group    string
+		lock     string
+		expected []string
+		missing  []string
+	}{
+		{
+			name:     "aws with group lookup",
+			provider: "aws",
+			expected: []string{"autoscaling:DescribeAutoScalingGroups", "ec2:DescribeInstances", "ec2:DescribeTags"},
+			missing:  []string{"dynamodb:"},
+		},
+		{
+			name:     "aws with a group name",
+			provider: "aws",
+			group:    "etcd",
+			expected: []string{"ec2:DescribeInstances"},
+			missing:  []string{"ec2:DescribeTags", "autoscaling:DescribeAutoScalingInstances"},
+		},
+		{
+			name:     "static with a bootstrap lock",
+			provider: "static",
+			lock:     "dynamodb",
+			expected: []string{"dynamodb:PutItem", "dynamodb:UpdateItem", "table/" + config.bootstrapLockTable},
+			missing:  []string{"ec2:"},
+		},
+		{name: "static", provider: "static"},
+	}
+	for _, c := range cases {
+		config.provider, config.groupName, config.bootstrapLock = c.provider, c.group, c.lock
+		policy, err := getIAMPolicy()
+		if len(c.expected) <= 0 {
+			if err == nil {
+				t.Errorf("case %s, expected an error as no policy is required", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		for _, x := range c.expected {
+			if !strings.Contains(policy, x) {
+				t.Errorf("case %s, expected the policy to contain: %s", c.name, x)
+			}
+		}
+		for _, x := range c.missing {
+			if strings.Contains(policy, x) {
+				t.Errorf("case %s, expected the policy not to contain: %s", c.name, x)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.etcd.io/etcd/server/v3/etcdserver"
+)
+
+// testCluster is a throwaway etcd cluster run in-process, with a member for each of the instances
+// in the fake; the members listen on their own loopback address, sharing the client and peer ports
+type testCluster struct {
+	t *testing.T
+	// the fake aws holding the instances
+	fake *fakeAWS
+	// the client port of the members
+	clientPort int
+	// the peer port of the members
+	peerPort int
+	// the directory holding the data directories
+	dir string
+	// the running members, keyed by instance id
+	members map[string]*embed.Etcd
+}
+
+// newTestCluster starts a cluster from the instances
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	if testing.Short() {
+		t.Skip("skipping the etcd integration tests in short mode")
+	}
+	r := &testCluster{
+		t:          t,
+		fake:       newFakeGroup(ids...),
+		clientPort: freePort(t),
+		peerPort:   freePort(t),
+		dir:        t.TempDir(),
+		members:    make(map[string]*embed.Etcd, 0),
+	}
+	t.Cleanup(r.close)
+
+	initial := r.initialCluster(ids...)
+	for _, id := range ids {
+		r.start(id, "new", initial, false)
+	}
+	for _, id := range ids {
+		r.waitReady(id)
+	}
+	// step: etcd refuses new voters until the members have been connected for the health interval
+	time.Sleep(etcdserver.HealthInterval)
+
+	return r
+}
+
+// freePort finds a port nothing is listening on
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// address returns the address of the instance
+func (r *testCluster) address(id string) string {
+	return r.fake.instances[id].ip
+}
+
+// initialCluster constructs the initial cluster from the instances
+func (r *testCluster) initialCluster(ids ...string) string {
+	var list []string
+	for _, id := range ids {
+		list = append(list, fmt.Sprintf("%s=http://%s:%d", id, r.address(id), r.peerPort))
+	}
+
+	return strings.Join(list, ",")
+}
+
+// start starts the member on the instance, optionally waiting for it to join the cluster
+func (r *testCluster) start(id, state, initial string, wait bool) {
+	cfg := embed.NewConfig()
+	cfg.Name = id
+	cfg.Dir = filepath.Join(r.dir, id)
+	cfg.LogLevel = "error"
+	cfg.TickMs = 10
+	cfg.ElectionMs = 100
+	cfg.ClusterState = state
+	cfg.InitialCluster = initial
+	cfg.InitialClusterToken = "etcd"
+	peerURL := url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", r.address(id), r.peerPort)}
+	clientURL := url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", r.address(id), r.clientPort)}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{clientURL}, []url.URL{clientURL}
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		r.t.Fatalf("failed to start the member: %s, error: %s", id, err)
+	}
+	r.members[id] = e
+	if wait {
+		r.waitReady(id)
+	}
+}
+
+// waitReady waits for the member to join the cluster
+func (r *testCluster) waitReady(id string) {
+	select {
+	case <-r.members[id].Server.ReadyNotify():
+	case err := <-r.members[id].Err():
+		r.t.Fatalf("the member: %s failed, error: %s", id, err)
+	case <-time.After(30 * time.Second):
+		r.t.Fatalf("the member: %s failed to join the cluster in time", id)
+	}
+}
+
+// stop stops the member on the instance, keeping its data
+func (r *testCluster) stop(id string) {
+	if e, found := r.members[id]; found {
+		e.Close()
+		delete(r.members, id)
+	}
+}
+
+// close stops all the members
+func (r *testCluster) close() {
+	for id := range r.members {
+		r.stop(id)
+	}
+}
+
+// useNode points the discovery at the cluster, running as the instance; it returns the environment
+// file and a function restoring the globals
+func (r *testCluster) useNode(id string) (string, func()) {
+	filename, restore := useFakeNode(r.t, r.fake, id)
+	store, _ = loadState(r.stateDir(id))
+	config.etcdClientScheme = "http"
+	config.etcdPeerScheme = "http"
+	config.etcdClientPort = r.clientPort
+	config.etcdPeerPort = r.peerPort
+	config.lockTimeout = 10 * time.Second
+
+	return filename, restore
+}
+
+// stateDir returns the state directory of the instance
+func (r *testCluster) stateDir(id string) string {
+	return filepath.Join(r.dir, "state", id)
+}
+
+// ageUnstarted moves the time the instance first saw the orphaned unstarted members back
+func (r *testCluster) ageUnstarted(id string, age time.Duration) {
+	state, err := loadState(r.stateDir(id))
+	if err != nil {
+		r.t.Fatalf("failed to load the state, error: %s", err)
+	}
+	for x := range state.Unstarted {
+		state.Unstarted[x] = state.Unstarted[x].Add(-age)
+	}
+	if err := state.save(); err != nil {
+		r.t.Fatalf("failed to save the state, error: %s", err)
+	}
+}
+
+// sync runs the membership sync as the instance, as runDiscovery would for an existing cluster
+func (r *testCluster) sync(id string) error {
+	_, restore := r.useNode(id)
+	defer restore()
+
+	self, group, err := discoverPeers()
+	if err != nil {
+		return err
+	}
+
+	return syncMembership(self, healthyPeers(group), group)
+}
+
+// memberList returns the members as name=peerurl, as seen by the member on the instance, with the
+// unstarted members unnamed
+func (r *testCluster) memberList(id string) []string {
+	var list []string
+	for _, m := range r.members[id].Server.Cluster().Members() {
+		list = append(list, fmt.Sprintf("%s=%s", m.Name, strings.Join(m.PeerURLs, ",")))
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// expectMembers waits for the member on the instance to see the expected members
+func (r *testCluster) expectMembers(id, scenario string, expected ...string) {
+	sort.Strings(expected)
+	var list []string
+	for i := 0; i < 50; i++ {
+		if list = r.memberList(id); strings.Join(list, " ") == strings.Join(expected, " ") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	r.t.Errorf("%s, expected the members: %v, got: %v", scenario, expected, list)
+}
+
+// peer returns the member entry of the instance, named or not
+func (r *testCluster) peer(name, id string) string {
+	return fmt.Sprintf("%s=http://%s:%d", name, r.address(id), r.peerPort)
+}
+
+func TestIntegrationJoin(t *testing.T) {
+	c := newTestCluster(t, "i-1", "i-2", "i-3")
+
+	if err := c.sync("i-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-1", "steady", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"))
+
+	// step: scale out, the new member is added but not yet started
+	c.fake.addGroup("etcd", 4)
+	c.fake.launch("etcd", "i-4", "127.0.0.14")
+	for i := 0; i < 2; i++ {
+		if err := c.sync("i-4"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	c.expectMembers("i-1", "added", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"), c.peer("", "i-4"))
+
+	// step: the member starts and joins the cluster
+	c.start("i-4", "existing", c.initialCluster("i-1", "i-2", "i-3", "i-4"), true)
+	if err := c.sync("i-4"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-4", "joined", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"), c.peer("i-4", "i-4"))
+}
+
+func TestIntegrationReplace(t *testing.T) {
+	c := newTestCluster(t, "i-1", "i-2", "i-3")
+
+	// step: the instance is terminated and the group launches a replacement
+	c.stop("i-3")
+	c.fake.terminate("i-3")
+	c.fake.launch("etcd", "i-4", "127.0.0.14")
+
+	if err := c.sync("i-4"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-1", "replaced", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("", "i-4"))
+
+	c.start("i-4", "existing", c.initialCluster("i-1", "i-2", "i-4"), true)
+	c.expectMembers("i-4", "joined", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-4", "i-4"))
+}
+
+func TestIntegrationRemovalWindow(t *testing.T) {
+	c := newTestCluster(t, "i-1", "i-2", "i-3", "i-4", "i-5")
+	defer func(saved int) { config.maxWindowRemovals = saved }(config.maxWindowRemovals)
+	config.maxWindowRemovals = 1
+
+	c.stop("i-4")
+	c.stop("i-5")
+	c.fake.terminate("i-4")
+	c.fake.terminate("i-5")
+
+	// step: the first node removes one of the dead members, recording it in the shared history
+	if err := c.sync("i-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// step: another node, with its own state directory, must see the removal within the window
+	if err := c.sync("i-2"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if list := c.memberList("i-1"); len(list) != 4 {
+		t.Errorf("expected a single removal within the window, got the members: %v", list)
+	}
+}
+
+func TestIntegrationUnstarted(t *testing.T) {
+	c := newTestCluster(t, "i-1", "i-2", "i-3")
+
+	c.fake.launch("etcd", "i-4", "127.0.0.14")
+	if err := c.sync("i-4"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// step: the unstarted member is kept while a live instance owns its peer url
+	if err := c.sync("i-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-1", "owned", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"), c.peer("", "i-4"))
+
+	// step: the instance dies before starting, the member is kept for the grace period
+	c.fake.terminate("i-4")
+	if err := c.sync("i-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-1", "orphaned", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"), c.peer("", "i-4"))
+
+	// step: once the grace period has passed the member is removed
+	c.ageUnstarted("i-1", config.unstartedGracePeriod+time.Minute)
+	if err := c.sync("i-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-1", "expired", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"))
+}
+
+func TestIntegrationQuorumLoss(t *testing.T) {
+	c := newTestCluster(t, "i-1", "i-2", "i-3")
+
+	// step: one instance is stopped and another terminated, losing quorum
+	c.stop("i-2")
+	c.stop("i-3")
+	c.fake.stop("i-2")
+	c.fake.terminate("i-3")
+
+	if err := c.sync("i-1"); err == nil {
+		t.Errorf("expected the sync to fail without quorum")
+	}
+	c.expectMembers("i-1", "quorum lost", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"), c.peer("i-3", "i-3"))
+
+	// step: the stopped instance returns, restoring quorum, and the terminated member is removed
+	c.fake.start("i-2", c.address("i-2"))
+	c.start("i-2", "existing", c.initialCluster("i-1", "i-2", "i-3"), true)
+	if err := c.sync("i-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.expectMembers("i-1", "recovered", c.peer("i-1", "i-1"), c.peer("i-2", "i-2"))
+}
+
+func TestIntegrationRefuseSplitBrain(t *testing.T) {
+	c := newTestCluster(t, "i-1")
+
+	// step: a second cluster is bootstrapped in the same group
+	c.fake.launch("etcd", "i-2", "127.0.0.12")
+	c.fake.launch("etcd", "i-3", "127.0.0.13")
+	c.start("i-2", "new", c.initialCluster("i-2"), true)
+
+	filename, restore := c.useNode("i-3")
+	defer restore()
+	config.refuseSplitBrain = true
+
+	if _, err := runDiscovery(); err != errSplitBrain {
+		t.Errorf("expected the node to refuse to join, got: %v", err)
+	}
+	if _, err := ioutil.ReadFile(filename); err == nil {
+		t.Errorf("the environment file should not have been written")
+	}
+	c.expectMembers("i-1", "first cluster", c.peer("i-1", "i-1"))
+	c.expectMembers("i-2", "second cluster", c.peer("i-2", "i-2"))
+}
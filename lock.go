@@ -0,0 +1,365 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/golang/glog"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// lockRetryInterval is the interval between attempts to acquire an external lock
+	lockRetryInterval = time.Duration(2) * time.Second
+)
+
+// errLockLost is returned when the lease behind a held lock has been lost
+var errLockLost = errors.New("the lease holding the lock has been lost")
+
+// etcdLocker is a lock held in the etcd cluster, bound to a lease which expires should we die
+type etcdLocker struct {
+	// the session holding the lease
+	session *concurrency.Session
+	// the mutex
+	mutex *concurrency.Mutex
+}
+
+// dynamoLocker is an external lock held as an item in a dynamodb table, acquired via a conditional
+// write and kept alive by a heartbeat while held, expiring after the lock ttl should we die
+type dynamoLocker struct {
+	// the dynamodb client
+	client dynamodbiface.DynamoDBAPI
+	// the name of the table
+	table string
+	// the id of the lock
+	key string
+	// the owner of the lock
+	owner string
+	// the time to wait to acquire the lock
+	timeout time.Duration
+	// closed to stop the heartbeat
+	stop chan struct{}
+	// closed once the heartbeat has stopped
+	done chan struct{}
+	// guards the lost error
+	mutex sync.Mutex
+	// the reason the lock was lost while held, if it was
+	lost error
+}
+
+// newMembershipLocker creates the lock serializing the membership changes, returning nil if disabled
+func newMembershipLocker(client *etcdClient) (locker, error) {
+	if !config.lock {
+		return nil, nil
+	}
+
+	return newEtcdLocker(client, config.lockKey)
+}
+
+// newBootstrapLocker creates the external lock used while no cluster is available, returning nil if
+// one is not configured
+func newBootstrapLocker(owner string) (locker, error) {
+	switch config.bootstrapLock {
+	case "":
+		return nil, nil
+	case "dynamodb":
+		group, err := discovery.group()
+		if err != nil {
+			return nil, err
+		}
+		cfg := &aws.Config{}
+		if config.bootstrapLockRegion != "" {
+			cfg.Region = aws.String(config.bootstrapLockRegion)
+		}
+		if config.bootstrapLockEndpoint != "" {
+			cfg.Endpoint = aws.String(config.bootstrapLockEndpoint)
+		}
+		// step: the holder may wait for the whole group before releasing the lock
+		timeout := config.lockTimeout
+		if config.bootstrapWait {
+			timeout += config.bootstrapTimeout
+		}
+
+		return newDynamoLocker(dynamodb.New(session.New(), cfg), config.bootstrapLockTable, group, owner, timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown bootstrap lock: %s", config.bootstrapLock)
+	}
+}
+
+// withLock runs the function while holding the lock, if any, failing should the lock be lost
+// before the function returns
+func withLock(l locker, fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+	if err := l.lock(); err != nil {
+		return fmt.Errorf("failed to acquire the lock, error: %s", err)
+	}
+	defer func() {
+		if err := l.unlock(); err != nil {
+			glog.Warningf("failed to release the lock, error: %s", err)
+		}
+	}()
+
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := l.held(); err != nil {
+		return fmt.Errorf("the lock was lost while held, error: %s", err)
+	}
+
+	return nil
+}
+
+// newEtcdLocker creates a lock on the key in etcd. The lease is granted within the lock timeout, as
+// the client retries the grant indefinitely when the cluster has lost quorum
+func newEtcdLocker(client *etcdClient, key string) (*etcdLocker, error) {
+	ctx, cancel := context.WithTimeout(shutdown, config.lockTimeout)
+	defer cancel()
+
+	lease, err := client.client.Grant(ctx, int64(config.lockTTL.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant the lock lease, error: %s", err)
+	}
+	session, err := concurrency.NewSession(client.client, concurrency.WithLease(lease.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a lock session, error: %s", err)
+	}
+
+	return &etcdLocker{session: session, mutex: concurrency.NewMutex(session, key)}, nil
+}
+
+// lock acquires the lock in etcd
+func (r *etcdLocker) lock() error {
+	glog.V(3).Infof("acquiring the etcd lock: %s", r.mutex.Key())
+	ctx, cancel := context.WithTimeout(shutdown, config.lockTimeout)
+	defer cancel()
+
+	if err := r.mutex.Lock(ctx); err != nil {
+		r.session.Close()
+		return err
+	}
+
+	return nil
+}
+
+// unlock releases the lock in etcd and revokes the lease
+func (r *etcdLocker) unlock() error {
+	defer r.session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return r.mutex.Unlock(ctx)
+}
+
+// held checks the session has kept the lease alive
+func (r *etcdLocker) held() error {
+	select {
+	case <-r.session.Done():
+		return errLockLost
+	default:
+		return nil
+	}
+}
+
+// newDynamoLocker creates a lock held in a dynamodb table, keyed by the LockID string attribute,
+// waiting up to the timeout to acquire it
+func newDynamoLocker(client dynamodbiface.DynamoDBAPI, table, key, owner string, timeout time.Duration) *dynamoLocker {
+	return &dynamoLocker{
+		client:  client,
+		table:   table,
+		key:     key,
+		owner:   owner,
+		timeout: timeout,
+	}
+}
+
+// lock acquires the lock, succeeding if the item does not exist, has expired or is already ours,
+// and starts the heartbeat keeping it alive
+func (r *dynamoLocker) lock() error {
+	glog.V(3).Infof("acquiring the dynamodb lock: %s, table: %s, timeout: %s", r.key, r.table, r.timeout)
+	r.stopHeartbeat()
+	deadline := time.Now().Add(r.timeout)
+
+	for {
+		now := time.Now()
+		_, err := r.client.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(r.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				"LockID":  {S: aws.String(r.key)},
+				"Owner":   {S: aws.String(r.owner)},
+				"Expires": {N: aws.String(strconv.FormatInt(now.Add(config.lockTTL).Unix(), 10))},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(LockID) OR #expires < :now OR #owner = :owner"),
+			ExpressionAttributeNames: map[string]*string{
+				"#expires": aws.String("Expires"),
+				"#owner":   aws.String("Owner"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now":   {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+				":owner": {S: aws.String(r.owner)},
+			},
+		})
+		if err == nil {
+			r.startHeartbeat(now.Add(config.lockTTL))
+			return nil
+		}
+		if !isConditionFailed(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the lock: %s", r.key)
+		}
+		glog.V(3).Infof("the lock: %s is held by another node, retrying in %s", r.key, lockRetryInterval)
+
+		if err := sleep(lockRetryInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// unlock stops the heartbeat and releases the lock, provided we still own it
+func (r *dynamoLocker) unlock() error {
+	r.stopHeartbeat()
+
+	_, err := r.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(r.key)},
+		},
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("Owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(r.owner)},
+		},
+	})
+	if isConditionFailed(err) {
+		glog.Warningf("the lock: %s had expired and was taken by another node", r.key)
+		return nil
+	}
+
+	return err
+}
+
+// held checks the heartbeat has kept the lock alive
+func (r *dynamoLocker) held() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.lost
+}
+
+// startHeartbeat starts extending the expiry of the lock, due to expire at the time given
+func (r *dynamoLocker) startHeartbeat(expires time.Time) {
+	r.mutex.Lock()
+	r.lost = nil
+	r.mutex.Unlock()
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.heartbeat(r.stop, r.done, expires)
+}
+
+// stopHeartbeat stops the heartbeat, if running, and waits for it to finish
+func (r *dynamoLocker) stopHeartbeat() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop, r.done = nil, nil
+}
+
+// heartbeat extends the expiry of the lock every third of the lock ttl until stopped. A failed
+// renewal is retried while the lock has time left, the lock is lost should another node take it
+// or it is about to expire
+func (r *dynamoLocker) heartbeat(stop, done chan struct{}, expires time.Time) {
+	defer close(done)
+	interval := config.lockTTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		next := time.Now().Add(config.lockTTL)
+		err := r.renew(next)
+		switch {
+		case err == nil:
+			glog.V(10).Infof("extended the lock: %s until: %s", r.key, next)
+			expires = next
+			continue
+		case isConditionFailed(err):
+			err = fmt.Errorf("the lock: %s has been taken by another node", r.key)
+		case time.Now().Add(interval).After(expires):
+			err = fmt.Errorf("failed to extend the lock: %s before it expires, error: %s", r.key, err)
+		default:
+			glog.Warningf("failed to extend the lock: %s, retrying, error: %s", r.key, err)
+			continue
+		}
+		glog.Errorf("%s", err)
+
+		r.mutex.Lock()
+		r.lost = err
+		r.mutex.Unlock()
+
+		return
+	}
+}
+
+// renew extends the expiry of the lock, provided we still own it
+func (r *dynamoLocker) renew(expires time.Time) error {
+	_, err := r.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(r.key)},
+		},
+		UpdateExpression:    aws.String("SET #expires = :expires"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expires": aws.String("Expires"),
+			"#owner":   aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+			":owner":   {S: aws.String(r.owner)},
+		},
+	})
+
+	return err
+}
+
+// isConditionFailed checks if the dynamodb request was refused by its condition
+func isConditionFailed(err error) bool {
+	e, ok := err.(awserr.Error)
+
+	return ok && e.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
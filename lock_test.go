@@ -0,0 +1,303 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamo is an in-memory stand-in for the dynamodb conditional writes used by the lock
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	sync.Mutex
+	// the lock items, keyed by the lock id
+	items map[string]map[string]*dynamodb.AttributeValue
+	// the number of calls, keyed by the operation
+	calls map[string]int
+	// an error returned by the renewals, if any
+	renewErr error
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{
+		items: make(map[string]map[string]*dynamodb.AttributeValue, 0),
+		calls: make(map[string]int, 0),
+	}
+}
+
+func (r *fakeDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls["PutItem"]++
+
+	id := aws.StringValue(input.Item["LockID"].S)
+	if current, found := r.items[id]; found {
+		expires, _ := strconv.ParseInt(aws.StringValue(current["Expires"].N), 10, 64)
+		now, _ := strconv.ParseInt(aws.StringValue(input.ExpressionAttributeValues[":now"].N), 10, 64)
+		if expires >= now && aws.StringValue(current["Owner"].S) != aws.StringValue(input.ExpressionAttributeValues[":owner"].S) {
+			return nil, conditionFailed()
+		}
+	}
+	r.items[id] = input.Item
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (r *fakeDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls["UpdateItem"]++
+
+	if r.renewErr != nil {
+		return nil, r.renewErr
+	}
+	current, found := r.items[aws.StringValue(input.Key["LockID"].S)]
+	if !found || aws.StringValue(current["Owner"].S) != aws.StringValue(input.ExpressionAttributeValues[":owner"].S) {
+		return nil, conditionFailed()
+	}
+	current["Expires"] = input.ExpressionAttributeValues[":expires"]
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (r *fakeDynamo) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls["DeleteItem"]++
+
+	id := aws.StringValue(input.Key["LockID"].S)
+	current, found := r.items[id]
+	if !found || aws.StringValue(current["Owner"].S) != aws.StringValue(input.ExpressionAttributeValues[":owner"].S) {
+		return nil, conditionFailed()
+	}
+	delete(r.items, id)
+
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// owner returns the owner of the lock, if held
+func (r *fakeDynamo) owner(id string) string {
+	r.Lock()
+	defer r.Unlock()
+	if current, found := r.items[id]; found {
+		return aws.StringValue(current["Owner"].S)
+	}
+
+	return ""
+}
+
+// set changes an attribute of the lock item
+func (r *fakeDynamo) set(id, name string, value *dynamodb.AttributeValue) {
+	r.Lock()
+	defer r.Unlock()
+	r.items[id][name] = value
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func useLockConfig(ttl, timeout time.Duration) func() {
+	saved := *config
+	config.lockTTL = ttl
+	config.lockTimeout = timeout
+
+	return func() { *config = saved }
+}
+
+func TestDynamoLocker(t *testing.T) {
+	defer useLockConfig(time.Minute, time.Millisecond)()
+
+	fake := newFakeDynamo()
+	first := newDynamoLocker(fake, "etcd-discovery", "etcd-group", "i-1", config.lockTimeout)
+	second := newDynamoLocker(fake, "etcd-discovery", "etcd-group", "i-2", config.lockTimeout)
+
+	if err := first.lock(); err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %s", err)
+	}
+	if err := second.lock(); err == nil {
+		t.Errorf("expected the second node to time out acquiring a held lock")
+	}
+	if err := first.lock(); err != nil {
+		t.Errorf("expected the owner to be able to acquire the lock again, error: %s", err)
+	}
+	if err := first.unlock(); err != nil {
+		t.Fatalf("unexpected error releasing the lock: %s", err)
+	}
+	if err := second.lock(); err != nil {
+		t.Errorf("expected the second node to acquire the released lock, error: %s", err)
+	}
+	if err := first.unlock(); err != nil {
+		t.Errorf("releasing a lock owned by another node should not fail, error: %s", err)
+	}
+	if owner := fake.owner("etcd-group"); owner != "i-2" {
+		t.Errorf("expected the lock to still be held by the second node, owner: %s", owner)
+	}
+
+	// step: an expired lock, i.e. the holder died, can be taken over
+	fake.set("etcd-group", "Expires", &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))})
+	if err := first.lock(); err != nil {
+		t.Errorf("expected an expired lock to be taken over, error: %s", err)
+	}
+	if owner := fake.owner("etcd-group"); owner != "i-1" {
+		t.Errorf("expected the expired lock to be taken over by the first node, owner: %s", owner)
+	}
+	first.unlock()
+	second.unlock()
+}
+
+func TestDynamoLockerContention(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the lock contention test in short mode")
+	}
+	defer useLockConfig(time.Minute, time.Minute)()
+
+	fake := newFakeDynamo()
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	holders, overlapped, completed := 0, false, 0
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			l := newDynamoLocker(fake, "etcd-discovery", "etcd-group", owner, config.lockTimeout)
+			err := withLock(l, func() error {
+				mutex.Lock()
+				holders++
+				overlapped = overlapped || holders > 1
+				mutex.Unlock()
+
+				time.Sleep(100 * time.Millisecond)
+
+				mutex.Lock()
+				holders--
+				mutex.Unlock()
+
+				return nil
+			})
+			if err != nil {
+				t.Errorf("node %s failed to run under the lock, error: %s", owner, err)
+				return
+			}
+			mutex.Lock()
+			completed++
+			mutex.Unlock()
+		}(fmt.Sprintf("i-%d", i))
+	}
+	wg.Wait()
+
+	if overlapped {
+		t.Errorf("expected the nodes to hold the lock one at a time")
+	}
+	if completed != 3 {
+		t.Errorf("expected every node to acquire the lock, completed: %d", completed)
+	}
+	if owner := fake.owner("etcd-group"); owner != "" {
+		t.Errorf("expected the lock to be released, owner: %s", owner)
+	}
+}
+
+func TestDynamoLockerHeartbeat(t *testing.T) {
+	defer useLockConfig(300*time.Millisecond, time.Millisecond)()
+
+	fake := newFakeDynamo()
+	l := newDynamoLocker(fake, "etcd-discovery", "etcd-group", "i-1", config.lockTimeout)
+
+	// step: the heartbeat keeps extending the lock while it is held
+	err := withLock(l, func() error {
+		time.Sleep(500 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error holding the lock: %s", err)
+	}
+	fake.Lock()
+	renewals := fake.calls["UpdateItem"]
+	fake.Unlock()
+	if renewals < 2 {
+		t.Errorf("expected the lock to be extended while held, renewals: %d", renewals)
+	}
+
+	// step: the critical section fails should another node take the lock
+	err = withLock(l, func() error {
+		fake.set("etcd-group", "Owner", &dynamodb.AttributeValue{S: aws.String("i-2")})
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	if err == nil {
+		t.Errorf("expected an error when the lock is taken while held")
+	}
+	if owner := fake.owner("etcd-group"); owner != "i-2" {
+		t.Errorf("expected the lock to be left with the other node, owner: %s", owner)
+	}
+
+	// step: the critical section fails should the renewals fail until the lock expires
+	fake.renewErr = awserr.New("ServiceUnavailable", "the service is unavailable", nil)
+	err = withLock(newDynamoLocker(fake, "etcd-discovery", "another-group", "i-1", config.lockTimeout), func() error {
+		time.Sleep(400 * time.Millisecond)
+		return nil
+	})
+	if err == nil {
+		t.Errorf("expected an error when the lock could not be extended")
+	}
+}
+
+func TestNewBootstrapLockerTimeout(t *testing.T) {
+	defer useLockConfig(time.Minute, 2*time.Minute)()
+	defer func(saved provider) { discovery = saved }(discovery)
+	config.bootstrapLock = "dynamodb"
+	config.bootstrapLockRegion = "eu-west-1"
+	config.bootstrapTimeout = 10 * time.Minute
+
+	var err error
+	if discovery, err = newStaticProvider("etcd0", defaultStaticGroup, "etcd0=10.0.0.10"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cases := []struct {
+		wait     bool
+		expected time.Duration
+	}{
+		{wait: false, expected: 2 * time.Minute},
+		{wait: true, expected: 12 * time.Minute},
+	}
+	for _, c := range cases {
+		config.bootstrapWait = c.wait
+		l, err := newBootstrapLocker("etcd0")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if timeout := l.(*dynamoLocker).timeout; timeout != c.expected {
+			t.Errorf("bootstrap wait: %t, expected a lock timeout of %s, got %s", c.wait, c.expected, timeout)
+		}
+	}
+}
+
+func TestWithLock(t *testing.T) {
+	called := false
+	if err := withLock(nil, func() error { called = true; return nil }); err != nil || !called {
+		t.Errorf("expected the function to be called without a lock")
+	}
+}
@@ -16,29 +16,36 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/golang/glog"
 )
 
 var (
-	// the aws client
-	awsCli *awsClient
+	// the peer provider
+	discovery provider
+	// the state persisted between runs
+	store *discoveryState
+	// shutdown is cancelled when the daemon is signalled to stop, interrupting any waits
+	shutdown = context.Background()
 )
 
 //
 // Steps:
 //  - grab the command line configuration
-//  - retrieve the instance identity document from metadata service
-//  - find the instances in the auto-scaling group
-//  - create a etcd client from the instance and see if we can connect the cluster
-//  - write out the environment file
+//  - in daemon mode the steps below are repeated on an interval until we are signalled
+//  - create the provider and retrieve the peer we are running on
+//  - find the peers in the group, i.e. the instances in the auto-scaling group
+//  - probe the peers and decide if we are joining an existing cluster or bootstrapping a new one
+//  - write out the environment file and any other outputs
+//  - issue the peer and server certificates for the node, if required
 //  - if in proxy mode we can exit here
-//  - check if the instance id exists in the cluster and if not, try to add us
-//  - list the members in the cluster and find the instance status, if terminated, try and remove
+//  - check if the peer exists in the cluster and if not, try to add us
+//  - list the members in the cluster and find the peer status, if dead or gone, try and remove
 //
 
 func main() {
@@ -47,175 +54,235 @@ func main() {
 	}
 	glog.Infof("starting %s version: %s, author: %s <%s>", program, version, author, email)
 
-	// step: retrieve this instances identity
-	identity, err := getInstanceIdentity()
+	// step: the iam policy is derived from the configuration alone
+	if config.command == "iam-policy" {
+		policy, err := getIAMPolicy()
+		if err != nil {
+			glog.Errorf("%s", err)
+			os.Exit(1)
+		}
+		fmt.Println(policy)
+		return
+	}
+
+	// step: create the peer provider
+	var err error
+	discovery, err = newProvider(config.provider)
 	if err != nil {
-		glog.Errorf("failed to get the instance identity, error: %s", err)
+		glog.Errorf("failed to create the %s provider, error: %s", config.provider, err)
 		os.Exit(1)
 	}
 
-	// step: create a aws client
-	awsCli, err = newAwsClient(identity.Region)
+	// step: load any state from previous runs
+	store, err = loadState(config.stateDir)
 	if err != nil {
-		glog.Errorf("failed to create a aws client, error: %s", err)
+		glog.Errorf("failed to load the state from: %s, error: %s", config.stateDir, err)
 		os.Exit(1)
 	}
 
-	// step: get a list of instances in the scaling group
-	instances, err := getAutoScalingMembers(identity)
+	switch config.command {
+	case "daemon":
+		err = runDaemon()
+	case "plan":
+		err = runPlan(false)
+	case "apply":
+		err = runPlan(true)
+	case "check":
+		err = runCheck()
+	default:
+		var changed bool
+		if changed, err = runDiscovery(); err == nil && !changed && config.unchangedExitCode != 0 {
+			glog.Infof("none of the outputs have changed, exiting with code: %d", config.unchangedExitCode)
+			os.Exit(config.unchangedExitCode)
+		}
+	}
 	if err != nil {
-		glog.Errorf("failed to retrieve a list of instance from auto-scaling group, error: %s", err)
+		glog.Errorf("%s", err)
 		os.Exit(1)
 	}
+}
 
-	cluster_state := "new"
+// runDaemon continually runs the discovery and reconciliation on an interval until signalled to stop
+func runDaemon() error {
+	glog.Infof("running in daemon mode, interval: %s, jitter: %s", config.syncInterval, config.syncJitter)
 
-	// step: create an etcd client for us
-	client, err := newEtcdClient(getEtcdEndpoints(instances))
-	if err != nil {
-		glog.Warningf("failed to create an etcd client, error: %s", err)
-	} else {
-		if _, err := client.listMembers(); err == nil {
-			cluster_state = "existing"
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	shutdown = ctx
+
+	for {
+		if _, err := runDiscovery(); err != nil && shutdown.Err() == nil {
+			glog.Errorf("failed to reconcile the cluster, error: %s", err)
+		}
+		if shutdown.Err() != nil {
+			break
+		}
+		// step: alert should the group be running more than one cluster
+		if group, err := discovery.peers(); err != nil {
+			glog.Warningf("failed to retrieve the peers for the split brain check, error: %s", err)
+		} else {
+			alertSplitBrain(healthyPeers(group))
+		}
+
+		interval := jitter(config.syncInterval, config.syncJitter)
+		glog.V(3).Infof("waiting %s before the next reconciliation", interval)
+
+		if err := sleep(interval); err != nil {
+			break
 		}
 	}
+	glog.Infof("received a signal to stop, shutting down")
+
+	return nil
+}
 
-	if config.proxyMode {
-		cluster_state = "existing"
+// runPlan computes and prints the changes required to the cluster membership, applying them if requested
+func runPlan(apply bool) error {
+	self, group, err := discoverPeers()
+	if err != nil {
+		return err
 	}
+	peers := healthyPeers(group)
 
-	// step: write out the environment file
-	glog.Infof("writing the environment variables to file: %s", config.environmentFile)
-	if err := writeEnvironment(config.environmentFile, identity, instances, cluster_state, config.proxyMode); err != nil {
-		glog.Errorf("failed to write the environment file, error: %s", err)
-		os.Exit(1)
+	client, err := newEtcdClient(getEtcdEndpoints(peers))
+	if err != nil {
+		return err
 	}
+	defer client.close()
 
-	// step: create an etcd client from the members if NOT in proxy mode
-	if !config.proxyMode {
-		glog.Infof("attempting to add the member: %s into the cluster", identity.InstanceID)
-		// step: update the etcd cluster
-		if err := syncMembership(identity, getEtcdEndpoints(instances)); err != nil {
-			glog.Errorf("failed to update the etcd cluster, error: %s", err)
-			os.Exit(1)
+	// step: only take the lock when we are making changes
+	var lock locker
+	if apply {
+		if lock, err = newMembershipLocker(client); err != nil {
+			return err
 		}
 	}
-}
 
-// getAutoScalingMembers retrieve the members from the auto-scaling group
-func getAutoScalingMembers(identity *awsIdentity) ([]*ec2.Instance, error) {
-	autoScalingGroupName := config.groupName
-	// step: are we in proxy mode?
-	if autoScalingGroupName == "" {
-		glog.Infof("etcd auto-scaling group not set, using instance id %s for search", identity.InstanceID)
-		name, err := awsCli.getAutoScalingGroupWithInstanceID(identity.InstanceID)
+	return withLock(lock, func() error {
+		view, err := getClusterView(client, self, peers, group)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		autoScalingGroupName = name
-	}
+		plan := guardPlan(view, planMembership(view))
 
-	glog.Infof("retrieving the instances from the group: %s", autoScalingGroupName)
-	// step: get a list of the instance
-	instances, err := awsCli.getAutoScalingInstances(autoScalingGroupName)
-	if err != nil {
-		return nil, err
-	}
+		fmt.Print(printPlan(plan))
+		if !apply || len(plan) <= 0 {
+			return nil
+		}
 
-	return instances, nil
+		return applyPlan(client, plan)
+	})
 }
 
-// syncMembership is responsible for adding the new member into the cluster and cleaning up anyone
-// that doesn't need to be there anymore
-func syncMembership(identity *awsIdentity, instances []string) error {
-	memberID := identity.InstanceID
-	client, err := newEtcdClient(instances)
+// runDiscovery discovers the peers, writes the environment file and syncs the cluster membership,
+// returning true if any of the outputs changed
+func runDiscovery() (bool, error) {
+	self, group, err := discoverPeers()
 	if err != nil {
-		return err
+		return false, err
 	}
+	peers := healthyPeers(group)
 
-	glog.Infof("retrievig a list of cluster members")
-	members, err := client.listMembers()
+	// step: decide if we are joining an existing cluster or bootstrapping a new one
+	cluster_state, err := detectClusterState(self, peers)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	glog.Infof("found %d members in the cluster", len(members))
+	// step: decide on the bootstrap while holding the bootstrap lock, if any
+	if cluster_state == "new" {
+		if peers, cluster_state, err = bootstrapCluster(self, peers); err != nil {
+			return false, err
+		}
+	}
 
-	// step: attempt to remove any boxes from the cluster which have terminated
-	glog.Infof("checking if any cluster members can been cleaned out")
+	// step: write out the environment file and any other outputs
+	groupName, err := discovery.group()
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve the group name, error: %s", err)
+	}
+	result := &discoveryResult{
+		Self:        self,
+		Peers:       peers,
+		Group:       groupName,
+		State:       cluster_state,
+		Proxy:       config.proxyMode,
+		Environment: getEnvironment(self, peers, cluster_state, groupName, config.proxyMode),
+	}
+	changed, err := writeOutputs(config.outputs, result)
+	if err != nil {
+		return false, err
+	}
 
-	// step: remove any members no longer required
-	for _, i := range members {
-		glog.V(10).Infof("checking if instance: %s, url: %s is still alive", i.Name, i.PeerURLs)
-		terminated, err := awsCli.isInstanceTerminated(i.Name)
-		if err != nil {
-			glog.Warningf("failed to determine if member %s is running, error: %s", i.Name, err)
-			continue
-		}
-		if terminated {
-			glog.Infof("member %s has been terminated, removing from the cluster", i.Name)
-			removed := false
-			for j := 0; j < 3; j++ {
-				if err := client.deleteMember(i.ID); err != nil {
-					glog.Errorf("failed to remove the member %s, error: %s", i.Name, err)
-					<-time.After(time.Duration(3) * time.Second)
-				} else {
-					glog.Infof("successfully remove the member: %s", i.Name)
-					removed = true
-					break
-				}
-			}
-
-			if !removed {
-				return fmt.Errorf("failed to remove the member: %s", i.Name)
-			}
+	// step: issue the certificates for the node if required
+	if config.tlsDir != "" {
+		glog.Infof("checking the node certificates in directory: %s", config.tlsDir)
+		if err := issueCertificates(self); err != nil {
+			return false, fmt.Errorf("failed to issue the node certificates, error: %s", err)
 		}
 	}
 
-	// step: if we are not in the cluster, attempt to add our self
-	glog.V(3).Infof("checking the member %s is part of the cluster", memberID)
-	if found, err := client.hasMember(memberID); err != nil {
-		return err
-	} else if !found {
-		glog.Infof("member %s is not presently part of the cluster, adding now", memberID)
-
-		nodeAddress := identity.PrivateDNSName
-		if config.privateIPs {
-			nodeAddress = identity.LocalIP
+	// step: create an etcd client from the members if NOT in proxy mode, nor bootstrapping
+	if cluster_state == "new" {
+		glog.Infof("bootstrapping a new cluster, skipping the membership sync")
+	} else if !config.proxyMode {
+		glog.Infof("attempting to add the member: %s into the cluster", self.Name)
+		// step: update the etcd cluster
+		if err := syncMembership(self, peers, group); err != nil {
+			return false, fmt.Errorf("failed to update the etcd cluster, error: %s", err)
 		}
-		peerURL := getPeerURL(nodeAddress)
+	}
 
-		glog.Infof("attempting to add the member, peerURL: %s", peerURL)
+	return changed, nil
+}
 
-		if err := client.addMember(memberID, peerURL); err != nil {
-			glog.Errorf("failed to add the member into the cluster, error: %s", err)
-		}
-		glog.Infof("successfully added the member: %s to cluster", memberID)
-	} else {
-		glog.Infof("member %s is already in the cluster, moving to cleanup", memberID)
+// discoverPeers retrieves the peer we are running on and all the peers in the group
+func discoverPeers() (*peer, []*peer, error) {
+	// step: retrieve the peer we are running on
+	self, err := discovery.self()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the identity of this node, error: %s", err)
 	}
 
-	return nil
+	// step: get a list of peers in the group
+	list, err := discovery.peers()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve a list of peers from the provider, error: %s", err)
+	}
+
+	return self, list, nil
 }
 
-func writeEnvironment(filename string, identity *awsIdentity, members []*ec2.Instance, state string, proxy bool) error {
-	// step: generate the cluster url
-	peersURL := getPeerURLs(members)
-	mode := "off"
-	if proxy {
-		mode = "on"
-	}
-	content := fmt.Sprintf(`
-ETCD_INITIAL_CLUSTER_STATE=%s
-ETCD_NAME=%s
-ETCD_INITIAL_CLUSTER="%s"
-ETCD_PROXY="%s"
-`, state, identity.InstanceID, peersURL, mode)
-
-	if err := writeFile(filename, content); err != nil {
+// syncMembership is responsible for adding the new member into the cluster and cleaning up anyone
+// that doesn't need to be there anymore
+func syncMembership(self *peer, peers, group []*peer) error {
+	client, err := newEtcdClient(getEtcdEndpoints(peers))
+	if err != nil {
 		return err
 	}
+	defer client.close()
 
-	return nil
+	// step: serialize the changes with any other nodes syncing the membership
+	lock, err := newMembershipLocker(client)
+	if err != nil {
+		return err
+	}
+
+	return withLock(lock, func() error {
+		// step: retrieve the members and the state of their instances
+		view, err := getClusterView(client, self, peers, group)
+		if err != nil {
+			return err
+		}
+
+		// step: work out and apply the changes required
+		plan := guardPlan(view, planMembership(view))
+		if len(plan) <= 0 {
+			glog.Infof("member %s is already in the cluster and no changes are required", self.Name)
+			return nil
+		}
+		glog.Infof("applying %d changes to the cluster membership", len(plan))
+
+		return applyPlan(client, plan)
+	})
 }
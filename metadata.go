@@ -0,0 +1,208 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// metadataTokenTTL is the lifetime in seconds of the imdsv2 session tokens
+	metadataTokenTTL = 21600
+	// metadataRequestTimeout is the time permitted for a single request to the metadata service
+	metadataRequestTimeout = time.Duration(2) * time.Second
+	// metadataMinBackoff is the initial backoff between attempts
+	metadataMinBackoff = time.Duration(250) * time.Millisecond
+	// metadataMaxBackoff is the maximum backoff between attempts
+	metadataMaxBackoff = time.Duration(10) * time.Second
+)
+
+// errMetadataNotFound is returned when the metadata path does not exist
+var errMetadataNotFound = errors.New("the metadata was not found")
+
+// metadataClient is a client for the instance metadata service, using imdsv2 session tokens
+type metadataClient struct {
+	// the base url of the metadata service
+	baseURL string
+	// the http client
+	client *http.Client
+	// the current session token, empty when using imdsv1
+	token string
+	// the time the token expires
+	expires time.Time
+}
+
+// newMetadataClient creates a client for the metadata service
+func newMetadataClient(baseURL string) *metadataClient {
+	return &metadataClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: metadataRequestTimeout},
+	}
+}
+
+// getInstanceIdentity retrieves the identity document and hostname of the instance
+func (r *metadataClient) getInstanceIdentity() (*awsIdentity, error) {
+	// step: retrieve the dynamic instance document
+	content, err := r.get("/latest/dynamic/instance-identity/document")
+	if err != nil {
+		return nil, err
+	}
+
+	// step: decode the response
+	instance := new(awsIdentity)
+	if err := json.Unmarshal([]byte(content), instance); err != nil {
+		return nil, err
+	}
+
+	hostname, err := r.get("/latest/meta-data/local-hostname")
+	if err != nil {
+		return nil, err
+	}
+	instance.PrivateDNSName = strings.TrimSpace(hostname)
+
+	return instance, nil
+}
+
+// getInstanceTag retrieves the value of the instance tag, returning an empty string when the tags
+// are not exposed to the metadata or the tag is not set
+func (r *metadataClient) getInstanceTag(key string) (string, error) {
+	value, err := r.get("/latest/meta-data/tags/instance/" + key)
+	if err == errMetadataNotFound {
+		return "", nil
+	}
+
+	return strings.TrimSpace(value), err
+}
+
+// get retrieves the metadata path, retrying with a backoff until the metadata timeout, as the
+// network may not be up yet when we are started at boot
+func (r *metadataClient) get(path string) (string, error) {
+	deadline := time.Now().Add(config.metadataTimeout)
+	for attempt := 0; ; attempt++ {
+		content, err := r.request(path)
+		if err == nil || err == errMetadataNotFound {
+			return content, err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("failed to retrieve the metadata: %s, error: %s", path, err)
+		}
+		delay := metadataBackoff(attempt)
+		glog.V(3).Infof("failed to retrieve the metadata: %s, retrying in %s, error: %s", path, delay, err)
+
+		if err := sleep(delay); err != nil {
+			return "", err
+		}
+	}
+}
+
+// request makes a single request for the metadata path
+func (r *metadataClient) request(path string) (string, error) {
+	token, err := r.getToken()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, r.baseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errMetadataNotFound
+	case http.StatusUnauthorized:
+		// step: the token has expired or been revoked, fetch another
+		r.token = ""
+		return "", fmt.Errorf("the metadata token was refused")
+	default:
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// getToken retrieves an imdsv2 session token, returning an empty token when the service does not
+// support them and imdsv1 is permitted
+func (r *metadataClient) getToken() (string, error) {
+	if r.token != "" && time.Now().Before(r.expires) {
+		return r.token, nil
+	}
+	req, err := http.NewRequest(http.MethodPut, r.baseURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(metadataTokenTTL))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return "", fmt.Errorf("failed to retrieve a metadata token, status code: %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if !config.metadataAllowV1 {
+			return "", fmt.Errorf("failed to retrieve a metadata token, status code: %d", resp.StatusCode)
+		}
+		glog.V(3).Infof("the metadata service refused a token, status code: %d, falling back to imdsv1", resp.StatusCode)
+		return "", nil
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	r.token = string(content)
+	// step: refresh the token well before it expires
+	r.expires = time.Now().Add(time.Duration(metadataTokenTTL/2) * time.Second)
+
+	return r.token, nil
+}
+
+// metadataBackoff returns the exponential backoff, with jitter, for the attempt
+func metadataBackoff(attempt int) time.Duration {
+	delay := metadataMaxBackoff
+	if attempt < 16 {
+		if d := metadataMinBackoff << uint(attempt); d < metadataMaxBackoff {
+			delay = d
+		}
+	}
+
+	return jitter(delay/2, delay/2)
+}
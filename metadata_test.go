@@ -0,0 +1,130 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeMetadata is a stand-in for the instance metadata service
+type fakeMetadata struct {
+	// require an imdsv2 token
+	tokenRequired bool
+	// refuse to issue tokens, as an imdsv1 only service
+	tokenless bool
+	// the number of requests to fail before answering
+	failures int
+	// the metadata paths
+	paths map[string]string
+}
+
+func (r *fakeMetadata) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if req.URL.Path == "/latest/api/token" {
+		if r.tokenless || req.Method != http.MethodPut || req.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("token"))
+		return
+	}
+	if r.tokenRequired && req.Header.Get("X-aws-ec2-metadata-token") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	content, found := r.paths[req.URL.Path]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(content))
+}
+
+func newFakeMetadata() *fakeMetadata {
+	return &fakeMetadata{
+		paths: map[string]string{
+			"/latest/dynamic/instance-identity/document": `{"instanceId":"i-1","region":"eu-west-1","privateIp":"10.0.1.10","availabilityZone":"eu-west-1a"}`,
+			"/latest/meta-data/local-hostname":           "ip-10-0-1-10.internal\n",
+		},
+	}
+}
+
+func TestMetadataClient(t *testing.T) {
+	defer func(timeout time.Duration, v1 bool) {
+		config.metadataTimeout, config.metadataAllowV1 = timeout, v1
+	}(config.metadataTimeout, config.metadataAllowV1)
+
+	cases := []struct {
+		name    string
+		fake    *fakeMetadata
+		allowV1 bool
+		failed  bool
+	}{
+		{name: "imdsv2 only", fake: &fakeMetadata{tokenRequired: true}},
+		{name: "imdsv1 fallback", fake: &fakeMetadata{tokenless: true}, allowV1: true},
+		{name: "imdsv1 refused", fake: &fakeMetadata{tokenless: true}, failed: true},
+		{name: "network coming up", fake: &fakeMetadata{tokenRequired: true, failures: 2}},
+		{name: "no fallback on errors", fake: &fakeMetadata{tokenRequired: true, failures: 1}, allowV1: true},
+	}
+	for _, c := range cases {
+		c.fake.paths = newFakeMetadata().paths
+		config.metadataAllowV1 = c.allowV1
+		config.metadataTimeout = time.Duration(5) * time.Second
+		if c.failed {
+			config.metadataTimeout = 0
+		}
+		server := httptest.NewServer(c.fake)
+
+		identity, err := newMetadataClient(server.URL + "/").getInstanceIdentity()
+		server.Close()
+		if c.failed {
+			if err == nil {
+				t.Errorf("case %s, expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		if identity.InstanceID != "i-1" || identity.PrivateDNSName != "ip-10-0-1-10.internal" {
+			t.Errorf("case %s, unexpected identity: %v", c.name, identity)
+		}
+	}
+}
+
+func TestMetadataInstanceTag(t *testing.T) {
+	fake := &fakeMetadata{tokenRequired: true, paths: map[string]string{
+		"/latest/meta-data/tags/instance/" + groupNameTag: "etcd-group",
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newMetadataClient(server.URL)
+
+	if value, err := client.getInstanceTag(groupNameTag); err != nil || value != "etcd-group" {
+		t.Errorf("expected the group tag, got: %q, error: %v", value, err)
+	}
+	if value, err := client.getInstanceTag("missing"); err != nil || value != "" {
+		t.Errorf("expected an empty value for a missing tag, got: %q, error: %v", value, err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+)
+
+// discoveryResult is the outcome of the discovery, handed to the output renderers
+type discoveryResult struct {
+	// Self is the peer we are running on
+	Self *peer `json:"self"`
+	// Peers is the list of healthy peers in the group
+	Peers []*peer `json:"peers"`
+	// Group is the name of the group
+	Group string `json:"group"`
+	// State is the initial cluster state, new or existing
+	State string `json:"state"`
+	// Proxy indicates the node is running in proxy mode
+	Proxy bool `json:"proxy"`
+	// Environment is the etcd environment for the node
+	Environment []*envVar `json:"environment"`
+}
+
+// outputSpec is a output to write the discovery result to
+type outputSpec struct {
+	// format is the name of the renderer
+	format string
+	// path is the file to write, - for stdout
+	path string
+	// template is the template file used by the template renderer
+	template string
+}
+
+// renderer renders the discovery result into a output format
+type renderer func(*discoveryResult, *outputSpec) ([]byte, error)
+
+// renderers is the supported output formats
+var renderers = map[string]renderer{
+	"env":      renderEnvironment,
+	"yaml":     renderYAML,
+	"json":     renderJSON,
+	"systemd":  renderSystemd,
+	"shell":    renderShell,
+	"template": renderTemplate,
+}
+
+// parseOutputSpec parses a output in the form format:path, or template=FILE:path
+func parseOutputSpec(value string) (*outputSpec, error) {
+	items := strings.SplitN(value, ":", 2)
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return nil, fmt.Errorf("invalid output: %s, should be format:path", value)
+	}
+	spec := &outputSpec{format: items[0], path: items[1]}
+
+	if strings.HasPrefix(spec.format, "template=") {
+		spec.format, spec.template = "template", strings.TrimPrefix(spec.format, "template=")
+	}
+	if _, found := renderers[spec.format]; !found {
+		return nil, fmt.Errorf("invalid output format: %s", spec.format)
+	}
+	if spec.format == "template" && spec.template == "" {
+		return nil, fmt.Errorf("the template output requires a template file, i.e. template=FILE:path")
+	}
+
+	return spec, nil
+}
+
+// writeOutputs renders the discovery result to each of the outputs, returning true if any of the
+// files have changed; output to stdout is always considered a change
+func writeOutputs(outputs []*outputSpec, result *discoveryResult) (bool, error) {
+	changed := false
+	for _, x := range outputs {
+		content, err := renderers[x.format](result, x)
+		if err != nil {
+			return false, fmt.Errorf("failed to render the %s output, error: %s", x.format, err)
+		}
+		if x.path == "-" {
+			if _, err := os.Stdout.Write(content); err != nil {
+				return false, err
+			}
+			changed = true
+			continue
+		}
+
+		updated, err := writeFile(x.path, string(content))
+		if err != nil {
+			return false, fmt.Errorf("failed to write the %s output: %s, error: %s", x.format, x.path, err)
+		}
+		if !updated {
+			glog.V(3).Infof("the %s output: %s is unchanged", x.format, x.path)
+			continue
+		}
+		glog.Infof("wrote the %s output to file: %s", x.format, x.path)
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// renderEnvironment renders a environment file
+func renderEnvironment(result *discoveryResult, _ *outputSpec) ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.WriteString("\n")
+	for _, x := range result.Environment {
+		fmt.Fprintf(b, "%s=\"%s\"\n", x.Name, x.Value)
+	}
+
+	return b.Bytes(), nil
+}
+
+// renderYAML renders a etcd configuration file, as passed to --config-file
+func renderYAML(result *discoveryResult, _ *outputSpec) ([]byte, error) {
+	b := new(bytes.Buffer)
+	for _, x := range result.Environment {
+		name := strings.Replace(strings.ToLower(strings.TrimPrefix(x.Name, "ETCD_")), "_", "-", -1)
+		fmt.Fprintf(b, "%s: %s\n", name, strconv.Quote(x.Value))
+	}
+
+	return b.Bytes(), nil
+}
+
+// renderJSON renders the full discovery result as json
+func renderJSON(result *discoveryResult, _ *outputSpec) ([]byte, error) {
+	content, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(content, '\n'), nil
+}
+
+// renderSystemd renders a systemd drop-in with the environment
+func renderSystemd(result *discoveryResult, _ *outputSpec) ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.WriteString("[Service]\n")
+	for _, x := range result.Environment {
+		fmt.Fprintf(b, "Environment=%s\n", strconv.Quote(x.Name+"="+x.Value))
+	}
+
+	return b.Bytes(), nil
+}
+
+// renderShell renders the environment as exports which can be eval'd by a shell
+func renderShell(result *discoveryResult, _ *outputSpec) ([]byte, error) {
+	b := new(bytes.Buffer)
+	for _, x := range result.Environment {
+		fmt.Fprintf(b, "export %s='%s'\n", x.Name, strings.Replace(x.Value, "'", `'\''`, -1))
+	}
+
+	return b.Bytes(), nil
+}
+
+// renderTemplate renders the user supplied go template with the discovery result
+func renderTemplate(result *discoveryResult, spec *outputSpec) ([]byte, error) {
+	content, err := ioutil.ReadFile(spec.template)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(spec.template).Funcs(template.FuncMap{
+		"join":      strings.Join,
+		"address":   func(p *peer) string { return p.address() },
+		"clientURL": func(p *peer) string { return getClientURL(p.address()) },
+		"peerURL":   func(p *peer) string { return getPeerURL(p.address()) },
+		"env": func(name string) string {
+			for _, x := range result.Environment {
+				if x.Name == name {
+					return x.Value
+				}
+			}
+			return ""
+		},
+	}).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(bytes.Buffer)
+	if err := tmpl.Execute(b, result); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestResult() *discoveryResult {
+	self := &peer{Name: "i-self", PrivateIP: "10.0.1.10", PrivateDNSName: "ip-10-0-1-10.internal"}
+	return &discoveryResult{
+		Self:  self,
+		Peers: []*peer{self},
+		Group: "etcd",
+		State: "new",
+		Environment: []*envVar{
+			{Name: "ETCD_NAME", Value: "i-self"},
+			{Name: "ETCD_INITIAL_CLUSTER_STATE", Value: "new"},
+		},
+	}
+}
+
+func TestParseOutputSpec(t *testing.T) {
+	cases := []struct {
+		value    string
+		format   string
+		path     string
+		template string
+		invalid  bool
+	}{
+		{value: "yaml:/etc/etcd/etcd.yaml", format: "yaml", path: "/etc/etcd/etcd.yaml"},
+		{value: "shell:-", format: "shell", path: "-"},
+		{value: "template=/etc/haproxy.tmpl:/etc/haproxy/etcd.cfg", format: "template", path: "/etc/haproxy/etcd.cfg", template: "/etc/haproxy.tmpl"},
+		{value: "template:/etc/haproxy/etcd.cfg", invalid: true},
+		{value: "xml:/tmp/etcd.xml", invalid: true},
+		{value: "/tmp/etcd", invalid: true},
+	}
+	for _, c := range cases {
+		spec, err := parseOutputSpec(c.value)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("output %s should be invalid", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("output %s should be valid, error: %s", c.value, err)
+			continue
+		}
+		if spec.format != c.format || spec.path != c.path || spec.template != c.template {
+			t.Errorf("output %s parsed incorrectly: %+v", c.value, spec)
+		}
+	}
+}
+
+func TestRenderers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-discovery")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpl := filepath.Join(dir, "peers.tmpl")
+	ioutil.WriteFile(tmpl, []byte(`{{ range .Peers }}server {{ .Name }} {{ clientURL . }}{{ end }}`), 0600)
+
+	cases := []struct {
+		spec     *outputSpec
+		expected string
+	}{
+		{spec: &outputSpec{format: "env"}, expected: "\nETCD_NAME=\"i-self\"\nETCD_INITIAL_CLUSTER_STATE=\"new\"\n"},
+		{spec: &outputSpec{format: "yaml"}, expected: "name: \"i-self\"\ninitial-cluster-state: \"new\"\n"},
+		{spec: &outputSpec{format: "systemd"}, expected: "[Service]\nEnvironment=\"ETCD_NAME=i-self\"\nEnvironment=\"ETCD_INITIAL_CLUSTER_STATE=new\"\n"},
+		{spec: &outputSpec{format: "shell"}, expected: "export ETCD_NAME='i-self'\nexport ETCD_INITIAL_CLUSTER_STATE='new'\n"},
+		{spec: &outputSpec{format: "template", template: tmpl}, expected: "server i-self https://ip-10-0-1-10.internal:2379"},
+	}
+	for _, c := range cases {
+		content, err := renderers[c.spec.format](newTestResult(), c.spec)
+		if err != nil {
+			t.Errorf("failed to render the %s output, error: %s", c.spec.format, err)
+			continue
+		}
+		if string(content) != c.expected {
+			t.Errorf("the %s output expected %q, got %q", c.spec.format, c.expected, string(content))
+		}
+	}
+}
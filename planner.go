@@ -0,0 +1,565 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// learnerReadyPercent is the proportion of the leader's log a learner must hold to be promoted
+const learnerReadyPercent = 0.9
+
+const (
+	// actionRemove removes a member from the cluster
+	actionRemove = "remove"
+	// actionUpdate updates the peer url of a member
+	actionUpdate = "update"
+	// actionPromote promotes a learner to a voting member
+	actionPromote = "promote"
+	// actionAdd adds a member into the cluster
+	actionAdd = "add"
+)
+
+// action is a single change to the cluster membership
+type action struct {
+	// Kind is the type of change, i.e. add, remove, update or promote
+	Kind string
+	// ID is the etcd member id, empty when adding a member
+	ID string
+	// Name is the name of the member
+	Name string
+	// PeerURL is the peer url for the add and update changes
+	PeerURL string
+	// Reason is a description of why the change is required
+	Reason string
+	// Blocked is the reason the change has been refused, empty if it can proceed
+	Blocked string
+}
+
+// clusterView is the state of the world the planner works from
+type clusterView struct {
+	// self is the peer we are running on
+	self *peer
+	// peers is the list of healthy peers in the group
+	peers []*peer
+	// members is the list of members in the etcd cluster
+	members []*member
+	// dead is the set of member ids whose instances are considered dead, with the reason
+	dead map[string]string
+	// healthy is the set of member ids which are reported healthy by etcd
+	healthy map[string]bool
+	// learners is the time each learner has been waiting for promotion, keyed by member id
+	learners map[string]time.Duration
+	// caughtUp is the set of learner ids whose raft log has caught up with the leader
+	caughtUp map[string]bool
+	// unstarted is the time each unstarted member has been without a live instance owning its
+	// peer url, keyed by member id
+	unstarted map[string]time.Duration
+	// removals is the history of member removals shared by the nodes
+	removals []time.Time
+	// history is false when the removal history could not be retrieved, refusing any removals
+	history bool
+}
+
+// planMembership computes the ordered list of changes required to reconcile the cluster
+// membership with the view; removals first, then updates, promotions and finally adding ourselves
+func planMembership(view *clusterView) []*action {
+	var removals, updates, promotions, additions []*action
+
+	peers := make(map[string]*peer, 0)
+	for _, p := range view.peers {
+		peers[p.Name] = p
+	}
+
+	found := false
+	for _, m := range view.members {
+		// step: rollback any learners which have failed to catch up, started or not; never ourselves,
+		// as we would only be added back as a new member with a stale data directory
+		isSelf := view.self != nil && isSelfMember(view.self, []*member{m})
+		if m.IsLearner && view.learners[m.ID] > config.learnerTimeout && !isSelf {
+			removals = append(removals, &action{
+				Kind:   actionRemove,
+				ID:     m.ID,
+				Name:   m.Name,
+				Reason: fmt.Sprintf("the learner failed to catch up within %s", config.learnerTimeout),
+			})
+			continue
+		}
+		// step: handle the members which were added but never started
+		if m.Name == "" {
+			if view.self != nil && containedIn(getPeerURL(view.self.address()), m.PeerURLs) {
+				found = true
+				continue
+			}
+			if reason, ok := view.dead[m.ID]; ok {
+				removals = append(removals, &action{
+					Kind:   actionRemove,
+					ID:     m.ID,
+					Reason: reason,
+				})
+			} else if waited, ok := view.unstarted[m.ID]; ok && waited > config.unstartedGracePeriod {
+				removals = append(removals, &action{
+					Kind:   actionRemove,
+					ID:     m.ID,
+					Reason: fmt.Sprintf("the member never started and no live instance has owned its peer url for %s", config.unstartedGracePeriod),
+				})
+			}
+			continue
+		}
+		if reason, ok := view.dead[m.ID]; ok {
+			removals = append(removals, &action{
+				Kind:   actionRemove,
+				ID:     m.ID,
+				Name:   m.Name,
+				Reason: reason,
+			})
+			continue
+		}
+		if view.self != nil && m.Name == view.self.Name {
+			found = true
+		}
+
+		// step: promote the learners which have caught up
+		if m.IsLearner && view.caughtUp[m.ID] {
+			promotions = append(promotions, &action{
+				Kind:   actionPromote,
+				ID:     m.ID,
+				Name:   m.Name,
+				Reason: "the learner has caught up with the leader",
+			})
+		}
+
+		// step: check the peer url is still correct
+		p, ok := peers[m.Name]
+		if !ok {
+			continue
+		}
+		if url := getPeerURL(p.address()); !containedIn(url, m.PeerURLs) {
+			updates = append(updates, &action{
+				Kind:    actionUpdate,
+				ID:      m.ID,
+				Name:    m.Name,
+				PeerURL: url,
+				Reason:  fmt.Sprintf("the peer url has changed from %s", strings.Join(m.PeerURLs, ",")),
+			})
+		}
+	}
+
+	// step: if we are not in the cluster, add ourselves
+	if view.self != nil && !found {
+		additions = append(additions, &action{
+			Kind:    actionAdd,
+			Name:    view.self.Name,
+			PeerURL: getPeerURL(view.self.address()),
+			Reason:  "the member is not part of the cluster",
+		})
+	}
+
+	return append(append(append(removals, updates...), promotions...), additions...)
+}
+
+// getClusterView retrieves the members of the cluster and works out which of them are dead
+func getClusterView(client *etcdClient, self *peer, peers, group []*peer) (*clusterView, error) {
+	glog.Infof("retrieving a list of cluster members")
+	members, err := client.listMembers()
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("found %d members in the cluster", len(members))
+
+	view := newClusterView(self, peers, members)
+
+	// step: check the health of the members
+	for _, m := range members {
+		view.healthy[m.ID] = client.isHealthy(m)
+		glog.V(10).Infof("member: %s, id: %s, healthy: %t", m.Name, m.ID, view.healthy[m.ID])
+	}
+
+	// step: track the progress of any learners
+	if err := trackLearners(client, view); err != nil {
+		return nil, err
+	}
+
+	// step: retrieve the removals made by any of the nodes within the removal window
+	if view.removals, err = client.getRemovals(config.removalsKey); err != nil {
+		glog.Warningf("failed to retrieve the removal history, refusing any removals, error: %s", err)
+	} else {
+		view.history = true
+	}
+
+	// step: work out which of the members are dead
+	if err := classifyMembers(view, group); err != nil {
+		return nil, err
+	}
+
+	return view, nil
+}
+
+// newClusterView creates an empty view of the members
+func newClusterView(self *peer, peers []*peer, members []*member) *clusterView {
+	return &clusterView{
+		self:      self,
+		peers:     peers,
+		members:   members,
+		dead:      make(map[string]string, 0),
+		healthy:   make(map[string]bool, 0),
+		learners:  make(map[string]time.Duration, 0),
+		caughtUp:  make(map[string]bool, 0),
+		unstarted: make(map[string]time.Duration, 0),
+	}
+}
+
+// classifyMembers matches the members in the view to the instances in the group, tracking those
+// which never started and marking any whose instances are dead
+func classifyMembers(view *clusterView, group []*peer) error {
+	members := view.members
+
+	// step: track the members which never started
+	if err := trackUnstarted(view, group); err != nil {
+		return err
+	}
+
+	// step: lookup any members which are not in the group
+	var names []string
+	for _, m := range members {
+		if m.Name != "" && findPeer(m.Name, group) == nil {
+			names = append(names, m.Name)
+		}
+	}
+	instances := make(map[string]*peer, 0)
+	if len(names) > 0 {
+		var err error
+		if instances, err = discovery.describe(names); err != nil {
+			return err
+		}
+	}
+
+	// step: check which of the members are dead
+	for _, m := range members {
+		if m.Name == "" {
+			continue
+		}
+		glog.V(10).Infof("checking if instance: %s, url: %s is still alive", m.Name, m.PeerURLs)
+		if reason := deadReason(m, members, group, instances); reason != "" {
+			glog.Infof("member %s is considered dead, %s", m.Name, reason)
+			view.dead[m.ID] = reason
+		}
+	}
+
+	return nil
+}
+
+// trackLearners records how long each learner has been waiting for promotion and whether its
+// raft log has caught up with the leader
+func trackLearners(client *etcdClient, view *clusterView) error {
+	changed := false
+	for _, m := range view.members {
+		if !m.IsLearner {
+			continue
+		}
+		if _, found := store.Learners[m.ID]; !found {
+			store.Learners[m.ID] = time.Now()
+			changed = true
+		}
+		view.learners[m.ID] = time.Since(store.Learners[m.ID])
+	}
+	// step: forget any members which are no longer learners
+	for id := range store.Learners {
+		if m := findMemberByID(id, view.members); m == nil || !m.IsLearner {
+			delete(store.Learners, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := store.save(); err != nil {
+			return err
+		}
+	}
+	if len(view.learners) <= 0 {
+		return nil
+	}
+
+	// step: compare the raft index of the learners with the leader
+	leaderIndex, err := client.leaderIndex()
+	if err != nil {
+		glog.Warningf("failed to retrieve the raft index of the leader, error: %s", err)
+		return nil
+	}
+	for _, m := range view.members {
+		if !m.IsLearner {
+			continue
+		}
+		index, err := client.memberIndex(m)
+		if err != nil {
+			glog.Infof("learner: %s is not answering yet, waited: %s", m.Name, view.learners[m.ID])
+			continue
+		}
+		glog.Infof("learner: %s, raft index: %d, leader index: %d, waited: %s", m.Name, index, leaderIndex, view.learners[m.ID])
+		view.caughtUp[m.ID] = isCaughtUp(index, leaderIndex)
+	}
+
+	return nil
+}
+
+// trackUnstarted matches the members which were added but never started back to the instances by
+// peer url, recording how long those without a live instance have been orphaned. An orphan is dead
+// straight away when the instance owning its peer url is terminated; otherwise the grace period
+// applies, which can only be tracked when the state is kept between runs
+func trackUnstarted(view *clusterView, group []*peer) error {
+	changed := false
+	for _, m := range view.members {
+		if m.Name != "" {
+			continue
+		}
+		owner := findPeerURLOwner(m, group)
+		if owner != nil && !isDeadState(owner.State) {
+			glog.Infof("unstarted member: %s is owned by the instance: %s, state: %s", m.ID, owner.Name, owner.State)
+			if _, found := store.Unstarted[m.ID]; found {
+				delete(store.Unstarted, m.ID)
+				changed = true
+			}
+			continue
+		}
+		if owner != nil {
+			view.dead[m.ID] = fmt.Sprintf("the instance %s owning the peer url of the unstarted member is %s", owner.Name, owner.State)
+			glog.Infof("unstarted member: %s, peer urls: %s is orphaned, %s", m.ID, strings.Join(m.PeerURLs, ","), view.dead[m.ID])
+			continue
+		}
+		if _, found := store.Unstarted[m.ID]; !found {
+			store.Unstarted[m.ID] = time.Now()
+			changed = true
+		}
+		if !store.isKept() {
+			glog.Warningf("unstarted member: %s, peer urls: %s has no live instance, but the grace period cannot be "+
+				"tracked between runs without a state directory, not removing it", m.ID, strings.Join(m.PeerURLs, ","))
+			continue
+		}
+		view.unstarted[m.ID] = time.Since(store.Unstarted[m.ID])
+		glog.Infof("unstarted member: %s, peer urls: %s has no live instance, waited: %s",
+			m.ID, strings.Join(m.PeerURLs, ","), view.unstarted[m.ID])
+	}
+	// step: forget any members which have started or gone
+	for id := range store.Unstarted {
+		if m := findMemberByID(id, view.members); m == nil || m.Name != "" {
+			delete(store.Unstarted, id)
+			changed = true
+		}
+	}
+	if changed {
+		return store.save()
+	}
+
+	return nil
+}
+
+// findPeerURLOwner finds the instance in the group whose peer url the member advertises, preferring
+// a live instance should the address have been reused
+func findPeerURLOwner(m *member, group []*peer) *peer {
+	var owner *peer
+	for _, p := range group {
+		if containedIn(getPeerURL(p.address()), m.PeerURLs) {
+			if !isDeadState(p.State) {
+				return p
+			}
+			owner = p
+		}
+	}
+
+	return owner
+}
+
+// isCaughtUp checks the learner index is within the threshold etcd uses for promotion
+func isCaughtUp(index, leaderIndex uint64) bool {
+	return leaderIndex > 0 && float64(index) >= float64(leaderIndex)*learnerReadyPercent
+}
+
+// deadReason works out if the instance behind a member is dead, returning the reason, or an empty
+// string if it is alive. The member is matched to the group by name, falling back to the peer url
+// when the name is unknown to the provider; otherwise the dead states and absence rules apply
+func deadReason(m *member, members []*member, group []*peer, instances map[string]*peer) string {
+	// step: is the member in the group?
+	if p := findPeer(m.Name, group); p != nil {
+		if isDeadState(p.State) {
+			return fmt.Sprintf("the instance is %s", p.State)
+		}
+		return ""
+	}
+
+	instance, found := instances[m.Name]
+	if !found {
+		// step: match on the peer url to a group peer which doesn't have a member of its own
+		for _, p := range group {
+			if containedIn(getPeerURL(p.address()), m.PeerURLs) && findMember(p.Name, members) == nil {
+				if isDeadState(p.State) {
+					return fmt.Sprintf("the instance %s owning the peer url is %s", p.Name, p.State)
+				}
+				return ""
+			}
+		}
+		if config.removeMissing {
+			return "the instance no longer exists"
+		}
+		return ""
+	}
+
+	if isDeadState(instance.State) {
+		return fmt.Sprintf("the instance is %s", instance.State)
+	}
+	if config.removeDetached {
+		return "the instance is no longer in the group"
+	}
+
+	return ""
+}
+
+// isDeadState checks if the instance state is one of the configured dead states
+func isDeadState(state string) bool {
+	return containedIn(state, config.deadStates)
+}
+
+// findPeer finds the peer by name
+func findPeer(name string, peers []*peer) *peer {
+	for _, p := range peers {
+		if p.Name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// findMemberByID finds the member by id
+func findMemberByID(id string, members []*member) *member {
+	for _, m := range members {
+		if m.ID == id {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// findMember finds the member by name
+func findMember(name string, members []*member) *member {
+	for _, m := range members {
+		if m.Name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// applyPlan performs the changes in the plan against the cluster, in order
+func applyPlan(client *etcdClient, plan []*action) error {
+	for _, x := range plan {
+		if x.Blocked != "" {
+			glog.Warningf("skipping the change: %s, blocked: %s", x, x.Blocked)
+			continue
+		}
+		glog.Infof("applying the change: %s", x)
+
+		switch x.Kind {
+		case actionRemove:
+			removed := false
+			for j := 0; j < 3; j++ {
+				if err := client.deleteMember(x.ID); err != nil {
+					glog.Errorf("failed to remove the member %s, error: %s", x.Name, err)
+					if err := sleep(time.Duration(3) * time.Second); err != nil {
+						return err
+					}
+				} else {
+					glog.Infof("successfully remove the member: %s", x.Name)
+					removed = true
+					break
+				}
+			}
+			if !removed {
+				return fmt.Errorf("failed to remove the member: %s", x.Name)
+			}
+			if err := client.recordRemoval(config.removalsKey, config.removalWindow); err != nil {
+				glog.Errorf("failed to record the removal in the removal history, error: %s", err)
+			}
+		case actionUpdate:
+			if err := client.updateMember(x.ID, x.PeerURL); err != nil {
+				return fmt.Errorf("failed to update the member: %s, error: %s", x.Name, err)
+			}
+			glog.Infof("successfully updated the member: %s, peerURL: %s", x.Name, x.PeerURL)
+		case actionPromote:
+			if promoted, err := client.promoteMember(x.ID); err != nil {
+				return fmt.Errorf("failed to promote the member: %s, error: %s", x.Name, err)
+			} else if !promoted {
+				glog.Infof("the learner: %s is not ready for promotion yet", x.Name)
+				continue
+			}
+			glog.Infof("successfully promoted the member: %s to a voting member", x.Name)
+		case actionAdd:
+			if err := client.addMember(x.Name, x.PeerURL, config.joinAsLearner); err != nil {
+				return fmt.Errorf("failed to add the member: %s into the cluster, error: %s", x.Name, err)
+			}
+			glog.Infof("successfully added the member: %s to cluster", x.Name)
+		default:
+			return fmt.Errorf("unknown change: %s", x.Kind)
+		}
+	}
+
+	return nil
+}
+
+// printPlan renders the plan in a human readable form
+func printPlan(plan []*action) string {
+	if len(plan) <= 0 {
+		return "No changes, the cluster membership is up to date.\n"
+	}
+
+	counts := make(map[string]int, 0)
+	b := new(strings.Builder)
+	for _, x := range plan {
+		if x.Blocked != "" {
+			counts["blocked"]++
+			fmt.Fprintf(b, "  %s\n      blocked: %s\n", x, x.Blocked)
+			continue
+		}
+		counts[x.Kind]++
+		fmt.Fprintf(b, "  %s\n", x)
+	}
+	fmt.Fprintf(b, "\nPlan: %d to add, %d to promote, %d to update, %d to remove, %d blocked.\n",
+		counts[actionAdd], counts[actionPromote], counts[actionUpdate], counts[actionRemove], counts["blocked"])
+
+	return b.String()
+}
+
+func (r action) String() string {
+	if r.Name == "" {
+		r.Name = "<unstarted>"
+	}
+	switch r.Kind {
+	case actionRemove:
+		return fmt.Sprintf("- remove member %s (id: %s): %s", r.Name, r.ID, r.Reason)
+	case actionUpdate:
+		return fmt.Sprintf("~ update member %s (id: %s) to %s: %s", r.Name, r.ID, r.PeerURL, r.Reason)
+	case actionPromote:
+		return fmt.Sprintf("^ promote learner %s (id: %s): %s", r.Name, r.ID, r.Reason)
+	case actionAdd:
+		return fmt.Sprintf("+ add member %s, peerURL: %s: %s", r.Name, r.PeerURL, r.Reason)
+	}
+
+	return fmt.Sprintf("? %s member %s", r.Kind, r.Name)
+}
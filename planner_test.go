@@ -0,0 +1,289 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanMembership(t *testing.T) {
+	self := &peer{Name: "i-self", PrivateDNSName: "self.internal", Healthy: true}
+	other := &peer{Name: "i-other", PrivateDNSName: "other.internal", Healthy: true}
+
+	cases := []struct {
+		name     string
+		view     *clusterView
+		expected []string
+	}{
+		{
+			name: "up to date",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}},
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}},
+				},
+			},
+		},
+		{
+			name: "add ourselves",
+			view: &clusterView{
+				self:    self,
+				peers:   []*peer{self, other},
+				members: []*member{{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}}},
+			},
+			expected: []string{"add:i-self"},
+		},
+		{
+			name: "remove terminated before adding",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}},
+					{ID: "3", Name: "i-dead", PeerURLs: []string{getPeerURL("dead.internal")}},
+				},
+				dead: map[string]string{"3": "the instance is terminated"},
+			},
+			expected: []string{"remove:i-dead", "add:i-self"},
+		},
+		{
+			name: "update changed peer url",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}},
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("old.internal")}},
+				},
+			},
+			expected: []string{"update:i-other"},
+		},
+		{
+			name: "promote caught up learner",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}},
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}, IsLearner: true},
+				},
+				learners: map[string]time.Duration{"2": time.Minute},
+				caughtUp: map[string]bool{"2": true},
+			},
+			expected: []string{"promote:i-other"},
+		},
+		{
+			name: "rollback timed out learner",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}},
+					{ID: "2", PeerURLs: []string{getPeerURL("other.internal")}, IsLearner: true},
+				},
+				learners: map[string]time.Duration{"2": config.learnerTimeout + time.Minute},
+			},
+			expected: []string{"remove:"},
+		},
+		{
+			name: "timed out learner is not ourselves",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}, IsLearner: true},
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}},
+				},
+				learners: map[string]time.Duration{"1": config.learnerTimeout + time.Minute},
+			},
+		},
+		{
+			name: "timed out unstarted learner is not ourselves",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", PeerURLs: []string{getPeerURL("self.internal")}, IsLearner: true},
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}},
+				},
+				learners: map[string]time.Duration{"1": config.learnerTimeout + time.Minute},
+			},
+		},
+		{
+			name: "unstarted self is not added again",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "2", Name: "i-other", PeerURLs: []string{getPeerURL("other.internal")}},
+					{ID: "3", PeerURLs: []string{getPeerURL("self.internal")}},
+				},
+			},
+		},
+		{
+			name: "orphaned unstarted within the grace period",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}},
+					{ID: "3", PeerURLs: []string{getPeerURL("gone.internal")}},
+				},
+				unstarted: map[string]time.Duration{"3": time.Minute},
+			},
+		},
+		{
+			name: "orphaned unstarted with a dead instance",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "1", Name: "i-self", PeerURLs: []string{getPeerURL("self.internal")}},
+					{ID: "3", PeerURLs: []string{getPeerURL("gone.internal")}},
+				},
+				dead:      map[string]string{"3": "the instance is terminated"},
+				unstarted: map[string]time.Duration{},
+			},
+			expected: []string{"remove:"},
+		},
+		{
+			name: "orphaned unstarted after the grace period",
+			view: &clusterView{
+				self:  self,
+				peers: []*peer{self, other},
+				members: []*member{
+					{ID: "3", PeerURLs: []string{getPeerURL("gone.internal")}},
+				},
+				unstarted: map[string]time.Duration{"3": config.unstartedGracePeriod + time.Minute},
+			},
+			expected: []string{"remove:", "add:i-self"},
+		},
+	}
+
+	for _, c := range cases {
+		plan := planMembership(c.view)
+		if len(plan) != len(c.expected) {
+			t.Errorf("case %s, expected %d changes, got %d: %v", c.name, len(c.expected), len(plan), plan)
+			continue
+		}
+		for i, x := range plan {
+			if got := x.Kind + ":" + x.Name; got != c.expected[i] {
+				t.Errorf("case %s, change %d expected %s, got %s", c.name, i, c.expected[i], got)
+			}
+		}
+	}
+}
+
+func TestDeadReason(t *testing.T) {
+	group := []*peer{
+		{Name: "i-running", PrivateDNSName: "running.internal", State: "running"},
+		{Name: "i-stopped", PrivateDNSName: "stopped.internal", State: "stopped"},
+		{Name: "i-renamed", PrivateDNSName: "renamed.internal", State: "running"},
+	}
+	instances := map[string]*peer{
+		"i-terminated": {Name: "i-terminated", State: "terminated"},
+		"i-detached":   {Name: "i-detached", State: "running"},
+	}
+
+	cases := []struct {
+		name     string
+		member   *member
+		detached bool
+		dead     bool
+	}{
+		{name: "running in group", member: &member{Name: "i-running"}},
+		{name: "stopped in group", member: &member{Name: "i-stopped"}},
+		{name: "terminated", member: &member{Name: "i-terminated"}, dead: true},
+		{name: "no longer exists", member: &member{Name: "i-gone"}, dead: true},
+		{name: "matched by peer url", member: &member{Name: "etcd0", PeerURLs: []string{getPeerURL("renamed.internal")}}},
+		{name: "detached is kept", member: &member{Name: "i-detached"}},
+		{name: "detached is removed", member: &member{Name: "i-detached"}, detached: true, dead: true},
+	}
+	for _, c := range cases {
+		config.removeDetached = c.detached
+		members := []*member{{Name: "i-running"}, {Name: "i-stopped"}, c.member}
+		if reason := deadReason(c.member, members, group, instances); (reason != "") != c.dead {
+			t.Errorf("case %s, expected dead: %t, got reason: %q", c.name, c.dead, reason)
+		}
+	}
+	config.removeDetached = false
+}
+
+func TestTrackUnstarted(t *testing.T) {
+	defer func(s *discoveryState, command string) { store, config.command = s, command }(store, config.command)
+	group := []*peer{
+		{Name: "i-booting", PrivateDNSName: "booting.internal", State: "pending"},
+		{Name: "i-dead", PrivateDNSName: "dead.internal", State: "terminated"},
+	}
+
+	cases := []struct {
+		name      string
+		dir       string
+		command   string
+		unstarted []string
+	}{
+		{
+			name:      "with a state dir",
+			dir:       t.TempDir(),
+			command:   "run",
+			unstarted: []string{"4"},
+		},
+		{
+			name:      "daemon without a state dir",
+			command:   "daemon",
+			unstarted: []string{"4"},
+		},
+		{
+			name:    "run without a state dir",
+			command: "run",
+		},
+	}
+	for _, c := range cases {
+		config.command = c.command
+		store, _ = loadState(c.dir)
+		view := newClusterView(nil, nil, []*member{
+			{ID: "1", Name: "i-running"},
+			{ID: "2", PeerURLs: []string{getPeerURL("booting.internal")}},
+			{ID: "3", PeerURLs: []string{getPeerURL("dead.internal")}},
+			{ID: "4", PeerURLs: []string{getPeerURL("gone.internal")}},
+		})
+		store.Unstarted["2"] = time.Now()
+		store.Unstarted["5"] = time.Now()
+
+		if err := trackUnstarted(view, group); err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		if _, found := view.dead["3"]; !found || len(view.dead) != 1 {
+			t.Errorf("case %s, expected only the member with a terminated instance dead, got: %v", c.name, view.dead)
+		}
+		if len(view.unstarted) != len(c.unstarted) {
+			t.Errorf("case %s, expected the orphans: %v, got: %v", c.name, c.unstarted, view.unstarted)
+		}
+		for _, id := range c.unstarted {
+			if _, found := view.unstarted[id]; !found {
+				t.Errorf("case %s, expected the member %s to be orphaned", c.name, id)
+			}
+		}
+		// step: the orphans are always recorded, the others forgotten
+		if _, found := store.Unstarted["4"]; !found || len(store.Unstarted) != 1 {
+			t.Errorf("case %s, expected the state to track only the orphaned member, got: %v", c.name, store.Unstarted)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// newProvider creates the peer provider by name
+func newProvider(name string) (provider, error) {
+	switch name {
+	case "aws":
+		return newAwsProvider()
+	case "static":
+		return newStaticProvider(config.staticName, config.staticGroup, config.staticPeers)
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", name)
+	}
+}
+
+// healthyPeers filters the peers down to those which are healthy
+func healthyPeers(peers []*peer) []*peer {
+	var list []*peer
+	for _, p := range peers {
+		if !p.Healthy {
+			glog.Warningf("the peer %s is not healthy, skipping as member", p.Name)
+			continue
+		}
+		list = append(list, p)
+	}
+
+	return list
+}
+
+// address returns the address we should use to reach the peer
+func (r peer) address() string {
+	if config.privateIPs {
+		return r.PrivateIP
+	}
+
+	return r.PrivateDNSName
+}
+
+func (r peer) String() string {
+	return fmt.Sprintf("name: %s, address: %s, zone: %s, healthy: %t",
+		r.Name, r.address(), r.Zone, r.Healthy)
+}
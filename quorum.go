@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// guardPlan checks the removals in the plan are safe to perform, blocking any which would risk
+// the quorum of the cluster, shrink it below the minimum size or exceed the removal limits. The
+// peer url updates are blocked when the cluster could not commit them without the member
+func guardPlan(view *clusterView, plan []*action) []*action {
+	voters := 0
+	healthy := 0
+	for _, m := range view.members {
+		if m.IsLearner {
+			continue
+		}
+		voters++
+		if view.healthy[m.ID] {
+			healthy++
+		}
+	}
+	removals := 0
+	recent := len(recentRemovals(view.removals, config.removalWindow))
+
+	for _, x := range plan {
+		if x.Kind == actionUpdate {
+			x.Blocked = guardUpdate(view, x, voters, healthy)
+			if x.Blocked != "" {
+				glog.Warningf("refusing to update the member: %s, %s", x.Name, x.Blocked)
+			}
+			continue
+		}
+		if x.Kind != actionRemove {
+			continue
+		}
+		// step: learners do not vote, so removing them cannot affect quorum
+		if m := findMemberByID(x.ID, view.members); m != nil && m.IsLearner {
+			continue
+		}
+		// step: work out the cluster after the removal
+		remaining := voters - 1
+		remainingHealthy := healthy
+		if view.healthy[x.ID] {
+			remainingHealthy--
+		}
+
+		switch {
+		case view.healthy[x.ID]:
+			x.Blocked = "the member is still reported as healthy by etcd"
+		case remaining < config.minClusterSize:
+			x.Blocked = fmt.Sprintf("the cluster would shrink to %d members, below the minimum of %d", remaining, config.minClusterSize)
+		case remainingHealthy < quorumSize(remaining):
+			x.Blocked = fmt.Sprintf("only %d of the remaining %d members are healthy, quorum requires %d",
+				remainingHealthy, remaining, quorumSize(remaining))
+		case !view.history:
+			x.Blocked = "the removal history could not be retrieved from the cluster"
+		case removals >= config.maxRemovals:
+			x.Blocked = fmt.Sprintf("the limit of %d removals per run has been reached", config.maxRemovals)
+		case recent+removals >= config.maxWindowRemovals:
+			x.Blocked = fmt.Sprintf("the limit of %d removals within %s has been reached", config.maxWindowRemovals, config.removalWindow)
+		}
+		if x.Blocked != "" {
+			glog.Warningf("refusing to remove the member: %s, %s", x.Name, x.Blocked)
+			continue
+		}
+
+		voters = remaining
+		healthy = remainingHealthy
+		removals++
+	}
+
+	return plan
+}
+
+// guardUpdate checks the cluster has quorum without the member being updated, as the member is
+// likely unreachable on its old peer url and the update must be committed by the others
+func guardUpdate(view *clusterView, x *action, voters, healthy int) string {
+	available := healthy
+	if m := findMemberByID(x.ID, view.members); m != nil && !m.IsLearner && view.healthy[x.ID] {
+		available--
+	}
+	if available < quorumSize(voters) {
+		return fmt.Sprintf("only %d of the %d members are healthy without it, quorum requires %d",
+			available, voters, quorumSize(voters))
+	}
+
+	return ""
+}
+
+// recentRemovals returns the removals made within the window
+func recentRemovals(list []time.Time, window time.Duration) []time.Time {
+	var recent []time.Time
+	for _, x := range list {
+		if time.Since(x) < window {
+			recent = append(recent, x)
+		}
+	}
+
+	return recent
+}
+
+// quorumSize returns the number of members required for quorum in a cluster of the size
+func quorumSize(size int) int {
+	return size/2 + 1
+}
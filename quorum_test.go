@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newGuardView(healthy, dead int) (*clusterView, []*action) {
+	view := &clusterView{healthy: make(map[string]bool, 0), history: true}
+	var plan []*action
+	for i := 0; i < healthy+dead; i++ {
+		m := &member{ID: fmt.Sprintf("%d", i), Name: fmt.Sprintf("i-%d", i)}
+		view.members = append(view.members, m)
+		if i < healthy {
+			view.healthy[m.ID] = true
+			continue
+		}
+		plan = append(plan, &action{Kind: actionRemove, ID: m.ID, Name: m.Name})
+	}
+
+	return view, plan
+}
+
+func countBlocked(plan []*action) int {
+	count := 0
+	for _, x := range plan {
+		if x.Blocked != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestGuardPlan(t *testing.T) {
+	store = &discoveryState{}
+
+	cases := []struct {
+		name    string
+		healthy int
+		dead    int
+		blocked int
+	}{
+		{name: "single failure in three", healthy: 2, dead: 1, blocked: 0},
+		{name: "quorum already lost", healthy: 1, dead: 2, blocked: 2},
+		{name: "per run limit", healthy: 3, dead: 2, blocked: 1},
+		{name: "below the minimum size", healthy: 1, dead: 1, blocked: 1},
+	}
+	for _, c := range cases {
+		view, plan := newGuardView(c.healthy, c.dead)
+		if blocked := countBlocked(guardPlan(view, plan)); blocked != c.blocked {
+			t.Errorf("case %s, expected %d blocked removals, got %d", c.name, c.blocked, blocked)
+		}
+	}
+}
+
+func TestGuardPlanHealthyMember(t *testing.T) {
+	store = &discoveryState{}
+	view, _ := newGuardView(3, 0)
+	plan := []*action{{Kind: actionRemove, ID: "0", Name: "i-0"}}
+
+	if blocked := countBlocked(guardPlan(view, plan)); blocked != 1 {
+		t.Errorf("expected the removal of a healthy member to be blocked")
+	}
+}
+
+func TestGuardPlanRemovalWindow(t *testing.T) {
+	store = &discoveryState{}
+	view, plan := newGuardView(2, 1)
+	for i := 0; i < config.maxWindowRemovals; i++ {
+		view.removals = append(view.removals, time.Now().Add(-time.Minute))
+	}
+
+	if blocked := countBlocked(guardPlan(view, plan)); blocked != 1 {
+		t.Errorf("expected the removal to be blocked by the removal window")
+	}
+
+	// step: removals older than the window should not count
+	view, plan = newGuardView(2, 1)
+	for i := 0; i < config.maxWindowRemovals; i++ {
+		view.removals = append(view.removals, time.Now().Add(-2*config.removalWindow))
+	}
+	if blocked := countBlocked(guardPlan(view, plan)); blocked != 0 {
+		t.Errorf("expected the removals outside the window to be ignored")
+	}
+}
+
+func TestGuardPlanNoHistory(t *testing.T) {
+	store = &discoveryState{}
+	view, plan := newGuardView(2, 1)
+	view.history = false
+
+	if blocked := countBlocked(guardPlan(view, plan)); blocked != 1 {
+		t.Errorf("expected the removal to be blocked without the removal history")
+	}
+}
+
+func TestGuardPlanUpdate(t *testing.T) {
+	store = &discoveryState{}
+	cases := []struct {
+		name    string
+		healthy int
+		dead    int
+		id      string
+		blocked int
+	}{
+		{name: "quorum without the member", healthy: 3, id: "0"},
+		{name: "quorum relies on the member", healthy: 2, dead: 1, id: "0", blocked: 1},
+		{name: "unhealthy member with quorum", healthy: 2, dead: 1, id: "2"},
+	}
+	for _, c := range cases {
+		view, _ := newGuardView(c.healthy, c.dead)
+		plan := []*action{{Kind: actionUpdate, ID: c.id, Name: "i-" + c.id}}
+		if blocked := countBlocked(guardPlan(view, plan)); blocked != c.blocked {
+			t.Errorf("case %s, expected %d blocked updates, got %d", c.name, c.blocked, blocked)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// clusterGroup is a set of peers reporting the same cluster id and member list
+type clusterGroup struct {
+	// ID is the id of the cluster
+	ID string
+	// Members is the sorted list of member names, or ids when unstarted
+	Members []string
+	// Peers is the sorted list of peers reporting the cluster
+	Peers []string
+}
+
+// clusterReport is the result of checking the group for more than one cluster
+type clusterReport struct {
+	// clusters is the list of clusters found in the group
+	clusters []*clusterGroup
+	// unreachable is the list of peers which did not answer, with their status
+	unreachable []string
+}
+
+// runCheck probes every peer in the group and reports the clusters found, failing when the group
+// is running more than one
+func runCheck() error {
+	group, err := discovery.peers()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve a list of peers from the provider, error: %s", err)
+	}
+	report := checkClusters(healthyPeers(group))
+
+	fmt.Print(printClusterReport(report))
+	if report.isSplit() {
+		return fmt.Errorf("split brain detected, the group is running %d clusters", report.clusterCount())
+	}
+
+	return nil
+}
+
+// checkClusters probes the peers and groups them by the cluster id and member list they report
+func checkClusters(peers []*peer) *clusterReport {
+	return groupProbes(probePeers(peers))
+}
+
+// groupProbes groups the peers which answered by the cluster id and member list they report
+func groupProbes(probes []*peerProbe) *clusterReport {
+	report := &clusterReport{}
+	groups := make(map[string]*clusterGroup, 0)
+
+	for _, x := range probes {
+		if x.status != probeAnswered {
+			report.unreachable = append(report.unreachable, fmt.Sprintf("%s (%s)", x.peer.Name, x.status))
+			continue
+		}
+		var names []string
+		for _, m := range x.members {
+			names = append(names, defaultValue(m.Name, m.ID))
+		}
+		sort.Strings(names)
+
+		key := x.clusterID + "/" + strings.Join(names, ",")
+		if _, found := groups[key]; !found {
+			groups[key] = &clusterGroup{ID: x.clusterID, Members: names}
+			report.clusters = append(report.clusters, groups[key])
+		}
+		groups[key].Peers = append(groups[key].Peers, x.peer.Name)
+	}
+	for _, x := range report.clusters {
+		sort.Strings(x.Peers)
+	}
+	sort.Slice(report.clusters, func(i, j int) bool {
+		return report.clusters[i].ID+strings.Join(report.clusters[i].Members, ",") <
+			report.clusters[j].ID+strings.Join(report.clusters[j].Members, ",")
+	})
+	sort.Strings(report.unreachable)
+
+	return report
+}
+
+// clusterCount returns the number of distinct cluster ids
+func (r *clusterReport) clusterCount() int {
+	ids := make(map[string]bool, 0)
+	for _, x := range r.clusters {
+		ids[x.ID] = true
+	}
+
+	return len(ids)
+}
+
+// isSplit checks if the group is running more than one cluster
+func (r *clusterReport) isSplit() bool {
+	return r.clusterCount() > 1
+}
+
+// alertSplitBrain checks the group for more than one cluster, logging an alert if found
+func alertSplitBrain(peers []*peer) bool {
+	report := checkClusters(peers)
+	if !report.isSplit() {
+		return false
+	}
+	for _, x := range report.clusters {
+		glog.Errorf("split brain detected, cluster: %s, members: %s, reported by: %s",
+			x.ID, strings.Join(x.Members, ","), strings.Join(x.Peers, ","))
+	}
+
+	return true
+}
+
+// printClusterReport renders the report in a human readable form
+func printClusterReport(report *clusterReport) string {
+	b := new(strings.Builder)
+	for _, x := range report.clusters {
+		fmt.Fprintf(b, "  cluster: %s, members: %s\n      reported by: %s\n",
+			x.ID, strings.Join(x.Members, ","), strings.Join(x.Peers, ","))
+	}
+	if len(report.unreachable) > 0 {
+		fmt.Fprintf(b, "  unreachable: %s\n", strings.Join(report.unreachable, ", "))
+	}
+
+	switch {
+	case report.isSplit():
+		fmt.Fprintf(b, "\nSplit brain: the group is running %d clusters.\n", report.clusterCount())
+	case len(report.clusters) > 1:
+		fmt.Fprintf(b, "\nOne cluster, although the peers disagree on its members.\n")
+	case len(report.clusters) == 1:
+		fmt.Fprintf(b, "\nOne cluster, all answering peers agree.\n")
+	default:
+		fmt.Fprintf(b, "\nNo clusters found, none of the peers answered.\n")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGroupProbes(t *testing.T) {
+	answered := func(name, id string, members ...string) *peerProbe {
+		probe := &peerProbe{peer: &peer{Name: name}, status: probeAnswered, clusterID: id}
+		for _, x := range members {
+			probe.members = append(probe.members, &member{ID: "id-" + x, Name: x})
+		}
+		return probe
+	}
+
+	cases := []struct {
+		name     string
+		probes   []*peerProbe
+		groups   int
+		split    bool
+		expected string
+	}{
+		{
+			name:     "single cluster",
+			probes:   []*peerProbe{answered("i-1", "a", "i-1", "i-2"), answered("i-2", "a", "i-2", "i-1")},
+			groups:   1,
+			expected: "all answering peers agree",
+		},
+		{
+			name:     "disagree on members",
+			probes:   []*peerProbe{answered("i-1", "a", "i-1", "i-2"), answered("i-2", "a", "i-2")},
+			groups:   2,
+			expected: "disagree on its members",
+		},
+		{
+			name: "split brain",
+			probes: []*peerProbe{
+				answered("i-1", "a", "i-1", "i-2"),
+				answered("i-2", "a", "i-1", "i-2"),
+				answered("i-3", "b", "i-3"),
+				{peer: &peer{Name: "i-4"}, status: probeDown},
+			},
+			groups:   2,
+			split:    true,
+			expected: "running 2 clusters",
+		},
+		{
+			name:     "nothing answered",
+			probes:   []*peerProbe{{peer: &peer{Name: "i-1"}, status: probeDown}},
+			expected: "none of the peers answered",
+		},
+	}
+	for _, c := range cases {
+		report := groupProbes(c.probes)
+		if len(report.clusters) != c.groups {
+			t.Errorf("case %s, expected %d groups, got %d", c.name, c.groups, len(report.clusters))
+		}
+		if report.isSplit() != c.split {
+			t.Errorf("case %s, expected split: %t", c.name, c.split)
+		}
+		if output := printClusterReport(report); !strings.Contains(output, c.expected) {
+			t.Errorf("case %s, expected the report to contain: %q, got: %s", c.name, c.expected, output)
+		}
+	}
+}
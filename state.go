@@ -0,0 +1,99 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const stateFilename = "state.json"
+
+// discoveryState is the state persisted between runs
+type discoveryState struct {
+	// ClusterID is the id of the cluster this node was last seen a member of
+	ClusterID string `json:"clusterId,omitempty"`
+	// Learners is the time each learner was first seen, keyed by member id
+	Learners map[string]time.Time `json:"learners,omitempty"`
+	// Unstarted is the time each unstarted member without an owner was first seen, keyed by member id
+	Unstarted map[string]time.Time `json:"unstarted,omitempty"`
+	// the directory the state is persisted to, empty keeps it in memory
+	dir string
+}
+
+// loadState reads in the state from the directory, returning an empty state if none exists or the
+// file cannot be decoded, i.e. it was torn by a crash
+func loadState(dir string) (*discoveryState, error) {
+	state := &discoveryState{
+		Learners:  make(map[string]time.Time, 0),
+		Unstarted: make(map[string]time.Time, 0),
+		dir:       dir,
+	}
+	if dir == "" {
+		return state, nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, stateFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		glog.Warningf("failed to decode the state in directory: %s, starting afresh, error: %s", dir, err)
+		state.ClusterID = ""
+		state.Learners = nil
+		state.Unstarted = nil
+	}
+	if state.Learners == nil {
+		state.Learners = make(map[string]time.Time, 0)
+	}
+	if state.Unstarted == nil {
+		state.Unstarted = make(map[string]time.Time, 0)
+	}
+
+	return state, nil
+}
+
+// save persists the state to the directory, if one is set
+func (r *discoveryState) save() error {
+	if r.dir == "" {
+		return nil
+	}
+	glog.V(10).Infof("persisting the state to directory: %s", r.dir)
+
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(filepath.Join(r.dir, stateFilename), content, 0600, -1, -1)
+}
+
+// isKept checks the state is kept between runs, either in the state directory or in memory while
+// running as a daemon
+func (r *discoveryState) isKept() bool {
+	return r.dir != "" || config.command == "daemon"
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-discovery")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := loadState(dir)
+	if err != nil {
+		t.Fatalf("failed to load an empty state, error: %s", err)
+	}
+	state.ClusterID = "cdf818194e3a8c32"
+	state.Learners["8e9e05c52164694d"] = time.Now()
+	if err := state.save(); err != nil {
+		t.Fatalf("failed to save the state, error: %s", err)
+	}
+
+	loaded, err := loadState(dir)
+	if err != nil {
+		t.Fatalf("failed to load the state, error: %s", err)
+	}
+	if loaded.ClusterID != state.ClusterID || len(loaded.Learners) != 1 {
+		t.Errorf("the state was not persisted, cluster id: %s, learners: %d", loaded.ClusterID, len(loaded.Learners))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only the state file in the directory, found %d files", len(files))
+	}
+}
+
+func TestLoadStateTorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-discovery")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []string{
+		``,
+		`{"clusterId": "cdf818194e3a8c32", "learn`,
+		`{"clusterId": "cdf818194e3a8c32", "learners": []}`,
+	}
+	for i, c := range cases {
+		if err := ioutil.WriteFile(filepath.Join(dir, stateFilename), []byte(c), 0600); err != nil {
+			t.Fatalf("failed to write the state file, error: %s", err)
+		}
+		state, err := loadState(dir)
+		if err != nil {
+			t.Errorf("case %d, expected the state to be loaded, error: %s", i, err)
+			continue
+		}
+		if state.ClusterID != "" || state.Learners == nil || state.Unstarted == nil {
+			t.Errorf("case %d, expected an empty state, got: %v", i, state)
+		}
+	}
+}
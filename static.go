@@ -0,0 +1,103 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultStaticGroup is the name of the static group unless one is given
+const defaultStaticGroup = "static"
+
+// newStaticProvider creates a provider from a list of name=address pairs
+func newStaticProvider(name, group, peers string) (*staticProvider, error) {
+	if name == "" {
+		return nil, fmt.Errorf("you must set the name of the node when using the static provider")
+	}
+	if group == "" {
+		return nil, fmt.Errorf("you must set the name of the group when using the static provider")
+	}
+	provider := &staticProvider{name: name, groupName: group}
+
+	for _, x := range strings.Split(peers, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		items := strings.SplitN(x, "=", 2)
+		if len(items) != 2 || items[0] == "" || items[1] == "" {
+			return nil, fmt.Errorf("invalid static peer: %s, should be name=address", x)
+		}
+		for _, p := range provider.list {
+			if p.Name == items[0] || p.PrivateIP == items[1] {
+				return nil, fmt.Errorf("duplicate static peer: %s, the names and addresses must be unique", x)
+			}
+		}
+		provider.list = append(provider.list, &peer{
+			Name:           items[0],
+			PrivateIP:      items[1],
+			PrivateDNSName: items[1],
+			Healthy:        true,
+			State:          "running",
+		})
+	}
+	if len(provider.list) <= 0 {
+		return nil, fmt.Errorf("no static peers have been defined")
+	}
+
+	return provider, nil
+}
+
+// self retrieves the peer for the running node
+func (r *staticProvider) self() (*peer, error) {
+	for _, p := range r.list {
+		if p.Name == r.name {
+			return p, nil
+		}
+	}
+	if config.proxyMode {
+		return &peer{Name: r.name, Healthy: true, State: "running"}, nil
+	}
+
+	return nil, fmt.Errorf("the node %s is not in the list of static peers", r.name)
+}
+
+// group returns the name of the static group, which stays the same as the peers change
+func (r *staticProvider) group() (string, error) {
+	return r.groupName, nil
+}
+
+// peers retrieves the list of peers
+func (r *staticProvider) peers() ([]*peer, error) {
+	return r.list, nil
+}
+
+// desiredCapacity is the number of static peers
+func (r *staticProvider) desiredCapacity() (int, error) {
+	return len(r.list), nil
+}
+
+// describe retrieves the named peers, any no longer in the list are considered gone
+func (r *staticProvider) describe(names []string) (map[string]*peer, error) {
+	list := make(map[string]*peer, 0)
+	for _, p := range r.list {
+		if containedIn(p.Name, names) {
+			list[p.Name] = p
+		}
+	}
+
+	return list, nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestNewStaticProvider(t *testing.T) {
+	cases := []struct {
+		name  string
+		node  string
+		group string
+		peers string
+		count int
+		ok    bool
+	}{
+		{name: "valid", node: "etcd0", group: "static", peers: "etcd0=10.0.0.10,etcd1=10.0.0.11,etcd2=10.0.0.12", count: 3, ok: true},
+		{name: "spaces and empty entries", node: "etcd0", group: "static", peers: " etcd0=10.0.0.10, ,etcd1=etcd1.internal,", count: 2, ok: true},
+		{name: "no node name", group: "static", peers: "etcd0=10.0.0.10"},
+		{name: "no group name", node: "etcd0", peers: "etcd0=10.0.0.10"},
+		{name: "no peers", node: "etcd0", group: "static", peers: " , "},
+		{name: "missing address", node: "etcd0", group: "static", peers: "etcd0=10.0.0.10,etcd1"},
+		{name: "empty address", node: "etcd0", group: "static", peers: "etcd0=10.0.0.10,etcd1="},
+		{name: "empty name", node: "etcd0", group: "static", peers: "etcd0=10.0.0.10,=10.0.0.11"},
+		{name: "duplicate name", node: "etcd0", group: "static", peers: "etcd0=10.0.0.10,etcd0=10.0.0.11"},
+		{name: "duplicate address", node: "etcd0", group: "static", peers: "etcd0=10.0.0.10,etcd1=10.0.0.10"},
+	}
+	for _, c := range cases {
+		provider, err := newStaticProvider(c.node, c.group, c.peers)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("case %s, expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		list, _ := provider.peers()
+		if len(list) != c.count {
+			t.Errorf("case %s, expected %d peers, got %d", c.name, c.count, len(list))
+		}
+		for _, p := range list {
+			if p.PrivateIP == "" || p.PrivateIP != p.PrivateDNSName || !p.Healthy || p.State != "running" {
+				t.Errorf("case %s, the peer %s is invalid: %v", c.name, p.Name, p)
+			}
+		}
+		if capacity, _ := provider.desiredCapacity(); capacity != c.count {
+			t.Errorf("case %s, expected a desired capacity of %d, got %d", c.name, c.count, capacity)
+		}
+	}
+}
+
+func TestStaticSelf(t *testing.T) {
+	defer func() { config.proxyMode = false }()
+
+	cases := []struct {
+		name    string
+		node    string
+		proxy   bool
+		address string
+		ok      bool
+	}{
+		{name: "member", node: "etcd1", address: "10.0.0.11", ok: true},
+		{name: "member in proxy mode", node: "etcd1", proxy: true, address: "10.0.0.11", ok: true},
+		{name: "unknown node", node: "etcd9"},
+		{name: "unknown node in proxy mode", node: "etcd9", proxy: true, ok: true},
+	}
+	for _, c := range cases {
+		config.proxyMode = c.proxy
+		provider, err := newStaticProvider(c.node, defaultStaticGroup, "etcd0=10.0.0.10,etcd1=10.0.0.11")
+		if err != nil {
+			t.Fatalf("case %s, unexpected error: %s", c.name, err)
+		}
+		self, err := provider.self()
+		if !c.ok {
+			if err == nil {
+				t.Errorf("case %s, expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %s, unexpected error: %s", c.name, err)
+			continue
+		}
+		if self.Name != c.node || self.PrivateIP != c.address || !self.Healthy {
+			t.Errorf("case %s, unexpected peer: %v", c.name, self)
+		}
+	}
+}
+
+func TestStaticGroup(t *testing.T) {
+	provider, err := newStaticProvider("etcd0", "etcd-lab", "etcd0=10.0.0.10,etcd1=10.0.0.11")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	grown, err := newStaticProvider("etcd0", "etcd-lab", "etcd0=10.0.0.10,etcd1=10.0.0.11,etcd2=10.0.0.12")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	group, _ := provider.group()
+	if group != "etcd-lab" {
+		t.Errorf("expected the group etcd-lab, got %s", group)
+	}
+	if name, _ := grown.group(); name != group {
+		t.Errorf("the group should not change with the peers, got %s and %s", group, name)
+	}
+}
+
+func TestStaticDescribe(t *testing.T) {
+	provider, err := newStaticProvider("etcd0", defaultStaticGroup, "etcd0=10.0.0.10,etcd1=10.0.0.11")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	found, err := provider.describe([]string{"etcd1", "etcd2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(found) != 1 || found["etcd1"] == nil || found["etcd1"].PrivateIP != "10.0.0.11" {
+		t.Errorf("expected only etcd1 to be described, got: %v", found)
+	}
+	if found, _ := provider.describe(nil); len(found) != 0 {
+		t.Errorf("expected no peers to be described, got: %v", found)
+	}
+}
@@ -16,79 +16,153 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"io/ioutil"
-	"net/http"
+	"math/rand"
 	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func getInstanceIdentity() (*awsIdentity, error) {
-	// step: retrieve the dynamic instance document
-	res, err := http.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
-	if err != nil {
-		return nil, err
-	}
-
-	// step: read in the response body
-	content, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
+// errShutdown is returned when a wait is interrupted by the shutdown
+var errShutdown = errors.New("interrupted by a signal to stop")
 
-	// step: decode the response
-	instance := new(awsIdentity)
-	if err := json.Unmarshal([]byte(content), instance); err != nil {
-		return nil, err
+// sleep waits for the duration, returning errShutdown should we be signalled to stop first
+func sleep(d time.Duration) error {
+	select {
+	case <-shutdown.Done():
+		return errShutdown
+	case <-time.After(d):
+		return nil
 	}
+}
 
-	hostname, err := getMetaLocalHostname()
-	if err != nil {
-		return nil, err
+// getEtcdEndpoints constructs a list of endpoints from a list of peers
+func getEtcdEndpoints(peers []*peer) []string {
+	var list []string
+	for _, i := range peers {
+		list = append(list, getClientURL(i.address()))
 	}
-	instance.PrivateDNSName = hostname
 
-	return instance, nil
+	return list
 }
 
-// getEtcdEndpoints constructs a list of endpoints from a list of aws instances
-func getEtcdEndpoints(instances []*ec2.Instance) []string {
-	var list []string
-	for _, i := range instances {
-		location := *i.PrivateDnsName
-		if config.privateIPs {
-			location = *i.PrivateIpAddress
+// writeFile atomically writes the content to the output file, with the output mode and owner. It
+// returns false, without touching the file, if the file already holds the content
+func writeFile(filename, content string) (bool, error) {
+	current, err := ioutil.ReadFile(filename)
+	if err == nil && string(current) == content {
+		return false, nil
+	}
+	exists := err == nil
+
+	// step: keep a copy of the previous file if required
+	if config.outputBackup && exists {
+		if err := os.Remove(filename + ".bak"); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err := ioutil.WriteFile(filename+".bak", current, 0600); err != nil {
+			return false, err
+		}
+		if err := os.Chmod(filename+".bak", config.outputMode); err != nil {
+			return false, err
 		}
-		list = append(list, fmt.Sprintf("%s://%s:%d", config.etcdClientScheme, location, config.etcdClientPort))
 	}
 
-	return list
+	if err := writeAtomic(filename, []byte(content), config.outputMode, config.outputUID, config.outputGID); err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
-func writeFile(filename, content string) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0444)
+// writeAtomic writes the content to the file via a temporary file and a rename, so the file is
+// never seen half written; a uid or gid of -1 leaves the owner unchanged
+func writeAtomic(filename string, content []byte, mode os.FileMode, uid, gid int) error {
+	// step: write the content to a temporary file in the same directory
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 
-	if _, err := file.WriteString(content); err != nil {
+	if _, err := file.Write(content); err != nil {
+		file.Close()
 		return err
 	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), mode); err != nil {
+		return err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(file.Name(), uid, gid); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	// step: move the file into place
+	return os.Rename(file.Name(), filename)
 }
 
-func getPeerURLs(members []*ec2.Instance) string {
-	var list []string
-	for _, i := range members {
-		node := *i.PrivateDnsName
-		if config.privateIPs {
-			node = *i.PrivateIpAddress
+// parseOwner parses a owner in the form user[:group], as names or ids, returning -1 for any unset
+func parseOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+	uid, gid := -1, -1
+	items := strings.SplitN(owner, ":", 2)
+
+	if items[0] != "" {
+		id, err := strconv.Atoi(items[0])
+		if err != nil {
+			u, err := user.Lookup(items[0])
+			if err != nil {
+				return -1, -1, err
+			}
+			if id, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, err
+			}
+		}
+		uid = id
+	}
+	if len(items) > 1 && items[1] != "" {
+		id, err := strconv.Atoi(items[1])
+		if err != nil {
+			g, err := user.LookupGroup(items[1])
+			if err != nil {
+				return -1, -1, err
+			}
+			if id, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, err
+			}
 		}
-		list = append(list, fmt.Sprintf("%s=%s", *i.InstanceId, getPeerURL(node)))
+		gid = id
+	}
+
+	return uid, gid, nil
+}
+
+// getPeerURLs constructs the initial cluster from the peers, sorted by name so every node
+// generates the same list
+func getPeerURLs(members []*peer) string {
+	sorted := append([]*peer{}, members...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var list []string
+	for _, i := range sorted {
+		list = append(list, fmt.Sprintf("%s=%s", i.Name, getPeerURL(i.address())))
 	}
 
 	return strings.Join(list, ",")
@@ -99,21 +173,30 @@ func getPeerURL(location string) string {
 	return fmt.Sprintf("%s://%s:%d", config.etcdPeerScheme, location, config.etcdPeerPort)
 }
 
-// getMetaLocalHostname retrieves the dns hostname from the metadata service
-func getMetaLocalHostname() (string, error) {
-	// step: retrieve the dynamic instance document
-	res, err := http.Get("http://169.254.169.254/latest/meta-data/local-hostname")
-	if err != nil {
-		return "", err
+// getClientURL construct the client url for the cluster member
+func getClientURL(location string) string {
+	return fmt.Sprintf("%s://%s:%d", config.etcdClientScheme, location, config.etcdClientPort)
+}
+
+// defaultValue returns the value, or the default if the value is empty
+func defaultValue(value, def string) string {
+	if value == "" {
+		return def
 	}
 
-	// step: read in the response body
-	content, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return "", err
+	return value
+}
+
+// uniqueList returns the values with any duplicates removed, keeping the order
+func uniqueList(values ...string) []string {
+	var list []string
+	for _, x := range values {
+		if !containedIn(x, list) {
+			list = append(list, x)
+		}
 	}
 
-	return string(content), nil
+	return list
 }
 
 // isScheme checks the scheme is valid
@@ -125,6 +208,88 @@ func isSchema(s string) bool {
 	return false
 }
 
+// isCommand checks the command is valid
+func isCommand(c string) bool {
+	switch c {
+	case "run", "daemon", "plan", "apply", "check", "iam-policy":
+		return true
+	}
+
+	return false
+}
+
+// jitter adds a random duration of up to max to the interval
+func jitter(interval, max time.Duration) time.Duration {
+	if max <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int63n(int64(max)))
+}
+
+// listValue is a flag value holding a comma separated list
+type listValue struct {
+	list *[]string
+}
+
+// newListValue creates a list flag value with the defaults
+func newListValue(list *[]string, defaults []string) *listValue {
+	*list = defaults
+	return &listValue{list: list}
+}
+
+func (r *listValue) String() string {
+	if r.list == nil {
+		return ""
+	}
+	return strings.Join(*r.list, ",")
+}
+
+func (r *listValue) Set(value string) error {
+	var list []string
+	for _, x := range strings.Split(value, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	*r.list = list
+
+	return nil
+}
+
+// multiValue is a flag value which can be repeated
+type multiValue struct {
+	list *[]string
+}
+
+// newMultiValue creates a repeatable flag value
+func newMultiValue(list *[]string) *multiValue {
+	return &multiValue{list: list}
+}
+
+func (r *multiValue) String() string {
+	if r.list == nil {
+		return ""
+	}
+	return strings.Join(*r.list, ",")
+}
+
+func (r *multiValue) Set(value string) error {
+	*r.list = append(*r.list, value)
+	return nil
+}
+
+// containedIn checks if the value is in the list
+func containedIn(v string, list []string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+
+	return false
+}
+
 // isPort checks the port is valid
 func isPort(p int) bool {
 	if p >= 1 && p <= 65534 {
@@ -135,7 +300,8 @@ func isPort(p int) bool {
 }
 
 func printUsage(message string) {
-	flag.Usage()
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [run|daemon|plan|apply|check|iam-policy] [options]\n\n", program)
+	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\n[error] %s\n", message)
 	os.Exit(1)
 }
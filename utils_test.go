@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcd-discovery")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	config.outputBackup = true
+	defer func() { config.outputBackup = false }()
+	filename := filepath.Join(dir, "etcd-discovery")
+
+	if changed, err := writeFile(filename, "ETCD_NAME=one\n"); err != nil || !changed {
+		t.Fatalf("expected the file to be written, changed: %t, error: %v", changed, err)
+	}
+	if changed, err := writeFile(filename, "ETCD_NAME=one\n"); err != nil || changed {
+		t.Errorf("expected the file to be unchanged, changed: %t, error: %v", changed, err)
+	}
+	if _, err := os.Stat(filename + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("no backup should exist until the file changes")
+	}
+	if changed, err := writeFile(filename, "ETCD_NAME=two\n"); err != nil || !changed {
+		t.Errorf("expected the file to be rewritten, changed: %t, error: %v", changed, err)
+	}
+
+	if changed, err := writeFile(filename, "ETCD_NAME=three\n"); err != nil || !changed {
+		t.Errorf("expected the file to be rewritten, changed: %t, error: %v", changed, err)
+	}
+
+	if content, _ := ioutil.ReadFile(filename); string(content) != "ETCD_NAME=three\n" {
+		t.Errorf("unexpected content: %q", string(content))
+	}
+	if content, _ := ioutil.ReadFile(filename + ".bak"); string(content) != "ETCD_NAME=two\n" {
+		t.Errorf("unexpected backup content: %q", string(content))
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != config.outputMode {
+		t.Errorf("unexpected file mode, info: %v, error: %v", info, err)
+	}
+	// step: no temporary files should be left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("expected only the file and backup, found %d files", len(files))
+	}
+}
+
+func TestSleepShutdown(t *testing.T) {
+	defer func(ctx context.Context) { shutdown = ctx }(shutdown)
+
+	if err := sleep(time.Millisecond); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown = ctx
+	cancel()
+	started := time.Now()
+	if err := sleep(time.Hour); err != errShutdown {
+		t.Errorf("expected the sleep to be interrupted, got: %v", err)
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("expected the sleep to return on the shutdown, took: %s", time.Since(started))
+	}
+}